@@ -1,2 +1,2 @@
 #!/bin/sh
-./main -d ./static -p 5001 > /var/log/server 2>&1
\ No newline at end of file
+exec ./main -static ./static -port 5001 > /var/log/server 2>&1
\ No newline at end of file
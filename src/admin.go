@@ -0,0 +1,40 @@
+// Administrative endpoints such as cancellation of transcode jobs are protected by a token.
+// The token is given via an environment variable ADMIN_TOKEN,
+// and a request should carry it in X-Admin-Token header.
+// If ADMIN_TOKEN is not set, administrative endpoints are disabled.
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+)
+
+const (
+	adminTokenHeader = "X-Admin-Token"
+)
+
+var (
+	adminToken string
+)
+
+func init() {
+	// get admin token from an environment variable
+	adminToken = os.Getenv("ADMIN_TOKEN")
+}
+
+// withAdmin rejects a request which does not carry the admin token
+func withAdmin(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.Error(w, "admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(adminTokenHeader)), []byte(adminToken)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		f(w, r)
+	}
+}
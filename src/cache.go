@@ -0,0 +1,256 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+// cacheTouchInterval is how often last access of a video is written into modification time of its directory,
+// which keeps the order of eviction across restarts
+const cacheTouchInterval = time.Minute
+
+// cacheEntry is a directory of a video under static/streams
+type cacheEntry struct {
+	size       int64 // bytes of all files of the video
+	lastAccess time.Time
+	touched    time.Time // when lastAccess was written on disk
+}
+
+// cacheManager tracks size and last access of each video directory under static/streams,
+// and evicts least recently played videos except pinned ones when the total size exceeds a budget
+type cacheManager struct {
+	lock       sync.Mutex
+	budget     int64 // bytes, 0 for no limit
+	entries    map[string]*cacheEntry
+	pinned     map[string]bool // videos never evicted, which may not have been transcoded yet
+	pinsLoaded bool            // eviction waits until pins are loaded from db, not to remove a pinned video by mistake
+}
+
+// cManager is a singleton instance of cacheManager
+var cManager = cacheManager{
+	entries: make(map[string]*cacheEntry),
+	pinned:  make(map[string]bool),
+}
+
+// cacheStats reports size of the cache, where pinned videos are separated from evictable ones
+type cacheStats struct {
+	Budget          int64 `json:"budget"` // bytes, 0 for no limit
+	PinnedSize      int64 `json:"pinned_size"`
+	PinnedVideos    int   `json:"pinned_videos"`
+	EvictableSize   int64 `json:"evictable_size"`
+	EvictableVideos int   `json:"evictable_videos"`
+}
+
+// scan loads every video directory under static/streams, whose modification time is regarded as the last access.
+// It is supposed to be called once on startup after reconciliation.
+func (cm *cacheManager) scan() {
+	videoEntries, err := ioutil.ReadDir(streamsDirPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Printf("failed to read streams directory, %s", err)
+		}
+		return
+	}
+	for _, videoEntry := range videoEntries {
+		if videoEntry.IsDir() {
+			cm.update(videoEntry.Name())
+		}
+	}
+}
+
+// update measures the directory of a video again after files are added or removed
+func (cm *cacheManager) update(videoID string) {
+	dirPath := hlsSaveDirPath(videoID)
+	info, errStat := os.Stat(dirPath)
+	size, errSize := dirSize(dirPath)
+
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if errStat != nil || errSize != nil {
+		delete(cm.entries, videoID)
+		return
+	}
+	e, ok := cm.entries[videoID]
+	if !ok {
+		e = &cacheEntry{lastAccess: info.ModTime(), touched: info.ModTime()}
+		cm.entries[videoID] = e
+	}
+	e.size = size
+}
+
+// touch records that a video is played now.
+// A video which is not tracked yet is ignored, it is added by update when its files are written.
+func (cm *cacheManager) touch(videoID string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	e, ok := cm.entries[videoID]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	e.lastAccess = now
+	if now.Sub(e.touched) >= cacheTouchInterval {
+		e.touched = now
+		if err := os.Chtimes(hlsSaveDirPath(videoID), now, now); err != nil {
+			logger.Printf("failed to record last access of %s, %s", videoID, err)
+		}
+	}
+}
+
+// loadPins replaces pinned videos with those saved in db
+func (cm *cacheManager) loadPins(sess *mgo.Session) error {
+	videoIDs, err := getPinnedVideoIDs(sess)
+	if err != nil {
+		return err
+	}
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	cm.pinned = make(map[string]bool)
+	for _, videoID := range videoIDs {
+		cm.pinned[videoID] = true
+	}
+	cm.pinsLoaded = true
+	return nil
+}
+
+// pin marks a video as pinned or not
+func (cm *cacheManager) pin(videoID string, pinned bool) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if pinned {
+		cm.pinned[videoID] = true
+	} else {
+		delete(cm.pinned, videoID)
+	}
+}
+
+// size returns bytes of files of a video, which is 0 if the video is not on disk
+func (cm *cacheManager) size(videoID string) int64 {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if e, ok := cm.entries[videoID]; ok {
+		return e.size
+	}
+	return 0
+}
+
+// stats sums up sizes of pinned and evictable videos
+func (cm *cacheManager) stats() cacheStats {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	s := cacheStats{Budget: cm.budget}
+	for videoID, e := range cm.entries {
+		if cm.pinned[videoID] {
+			s.PinnedSize += e.size
+			s.PinnedVideos++
+		} else {
+			s.EvictableSize += e.size
+			s.EvictableVideos++
+		}
+	}
+	return s
+}
+
+// restorePins loads pinned videos from db, so that stats separate them whatever the budget is.
+// It is supposed to be called once on startup, and enforce tries again if db is unavailable then.
+func (cm *cacheManager) restorePins() {
+	sess, errDial := mgo.Dial(mongoURL)
+	if errDial != nil {
+		logger.Printf("failed to connect to db, pinned videos are loaded later, %s", errDial)
+		return
+	}
+	defer sess.Close()
+	if err := cm.loadPins(sess); err != nil {
+		logger.Printf("failed to load pinned videos, %s", err)
+	}
+}
+
+// enforce evicts videos beyond the budget, and removes their segment list file urls from db,
+// so that their streams are rebuilt on the next request.
+// Eviction is postponed while db is unavailable, since pins are unknown and urls cannot be removed.
+func (cm *cacheManager) enforce() {
+	cm.lock.Lock()
+	budget, pinsLoaded := cm.budget, cm.pinsLoaded
+	cm.lock.Unlock()
+	if budget <= 0 {
+		return
+	}
+	sess, errDial := mgo.Dial(mongoURL)
+	if errDial != nil {
+		logger.Printf("failed to connect to db, eviction is postponed, %s", errDial)
+		return
+	}
+	defer sess.Close()
+	if !pinsLoaded {
+		if err := cm.loadPins(sess); err != nil {
+			logger.Printf("failed to load pinned videos, eviction is postponed, %s", err)
+			return
+		}
+	}
+
+	for _, videoID := range cm.evict() {
+		if err := unsetVideoSegmentListFileURLs(sess, videoID); err != nil {
+			logger.Printf("failed to remove segment list file urls of %s from db, %s", videoID, err)
+		}
+	}
+}
+
+// evict removes directories of least recently played videos until the total size fits in the budget.
+// Pinned videos and videos being transcoded are skipped, but their size counts towards the budget.
+// It returns ids of evicted videos.
+func (cm *cacheManager) evict() []string {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if cm.budget <= 0 || !cm.pinsLoaded {
+		return nil
+	}
+	var total int64
+	videoIDs := make([]string, 0, len(cm.entries))
+	for videoID, e := range cm.entries {
+		total += e.size
+		videoIDs = append(videoIDs, videoID)
+	}
+	sort.Slice(videoIDs, func(i, j int) bool {
+		return cm.entries[videoIDs[i]].lastAccess.Before(cm.entries[videoIDs[j]].lastAccess)
+	})
+
+	evicted := make([]string, 0)
+	for _, videoID := range videoIDs {
+		if total <= cm.budget {
+			break
+		}
+		if cm.pinned[videoID] || jManager.running(videoID) {
+			continue
+		}
+		if err := os.RemoveAll(hlsSaveDirPath(videoID)); err != nil {
+			logger.Printf("failed to evict %s, %s", videoID, err)
+			continue
+		}
+		logger.Printf("evict %s of %d bytes to keep streams within %d bytes", videoID, cm.entries[videoID].size, cm.budget)
+		total -= cm.entries[videoID].size
+		delete(cm.entries, videoID)
+		evicted = append(evicted, videoID)
+	}
+	return evicted
+}
+
+// dirSize sums up sizes of all files under a directory
+func dirSize(dirPath string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dirPath, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCacheEvict(t *testing.T) {
+	_, cleanup := withTempStaticDir(t)
+	defer cleanup()
+
+	// videos of 100 bytes each played in order of old, middle, new
+	now := time.Now()
+	for i, videoID := range []string{"old", "middle", "new"} {
+		profileDirPath := hlsProfileDirPath(videoID, "aac128")
+		if err := os.MkdirAll(profileDirPath, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(profileDirPath, "segment0000.ts"), make([]byte, 100), 0666); err != nil {
+			t.Fatal(err)
+		}
+		accessed := now.Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(hlsSaveDirPath(videoID), accessed, accessed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cm := &cacheManager{entries: make(map[string]*cacheEntry), pinned: make(map[string]bool)}
+	cm.scan()
+	if len(cm.entries) != 3 || cm.entries["old"].size != 100 {
+		t.Fatalf("3 videos of 100 bytes expected, got %v", cm.entries)
+	}
+
+	if evicted := cm.evict(); len(evicted) != 0 {
+		t.Errorf("nothing should be evicted without budget, got %v", evicted)
+	}
+
+	// nothing is evicted until pins are known
+	cm.budget = 150
+	if evicted := cm.evict(); len(evicted) != 0 {
+		t.Errorf("nothing should be evicted before pins are loaded, got %v", evicted)
+	}
+	cm.pinsLoaded = true
+
+	// old is played now, and middle is being transcoded
+	cm.touch("old")
+	job := newTranscodeJob("middle", transcodeProfiles["aac64"], priorityPlay)
+	jManager.jobs[job.key()] = job
+	defer jManager.remove(job)
+
+	if evicted := cm.evict(); !reflect.DeepEqual(evicted, []string{"new", "old"}) {
+		t.Errorf("evicted videos expected %v, got %v", []string{"new", "old"}, evicted)
+	}
+	if _, err := os.Stat(hlsSaveDirPath("new")); !os.IsNotExist(err) {
+		t.Errorf("directory of an evicted video should be removed, %v", err)
+	}
+	if _, err := os.Stat(hlsSaveDirPath("middle")); err != nil {
+		t.Errorf("directory of a video being transcoded should be kept, %s", err)
+	}
+}
+
+func TestCachePin(t *testing.T) {
+	_, cleanup := withTempStaticDir(t)
+	defer cleanup()
+
+	cm := &cacheManager{
+		budget:     100,
+		pinsLoaded: true,
+		pinned:     make(map[string]bool),
+		entries: map[string]*cacheEntry{
+			"pinned":    {size: 300, lastAccess: time.Now().Add(-time.Hour)},
+			"evictable": {size: 200, lastAccess: time.Now()},
+		},
+	}
+	cm.pin("pinned", true)
+	expected := cacheStats{Budget: 100, PinnedSize: 300, PinnedVideos: 1, EvictableSize: 200, EvictableVideos: 1}
+	if stats := cm.stats(); stats != expected {
+		t.Errorf("stats expected %v, got %v", expected, stats)
+	}
+
+	// pinned video is kept even if the budget is still exceeded
+	if evicted := cm.evict(); !reflect.DeepEqual(evicted, []string{"evictable"}) {
+		t.Errorf("evicted videos expected %v, got %v", []string{"evictable"}, evicted)
+	}
+	cm.pin("pinned", false)
+	if evicted := cm.evict(); !reflect.DeepEqual(evicted, []string{"pinned"}) {
+		t.Errorf("unpinned video should be evicted, got %v", evicted)
+	}
+}
+
+func TestCacheEvictAfterRestart(t *testing.T) {
+	_, cleanup := withTempStaticDir(t)
+	defer cleanup()
+
+	// videos of 100 bytes each played in order of old, new
+	now := time.Now()
+	for i, videoID := range []string{"old", "new"} {
+		profileDirPath := hlsProfileDirPath(videoID, "aac128")
+		if err := os.MkdirAll(profileDirPath, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(profileDirPath, "segment0000.ts"), make([]byte, 100), 0666); err != nil {
+			t.Fatal(err)
+		}
+		accessed := now.Add(time.Duration(i-2) * time.Hour)
+		if err := os.Chtimes(hlsSaveDirPath(videoID), accessed, accessed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cm := &cacheManager{entries: make(map[string]*cacheEntry), pinned: make(map[string]bool)}
+	cm.scan()
+	cm.touch("old")
+
+	// the order of last access is restored from disk after restart
+	restarted := &cacheManager{budget: 150, pinsLoaded: true, entries: make(map[string]*cacheEntry), pinned: make(map[string]bool)}
+	restarted.scan()
+	if evicted := restarted.evict(); !reflect.DeepEqual(evicted, []string{"new"}) {
+		t.Errorf("video played least recently before restart should be evicted, got %v", evicted)
+	}
+}
+
+func TestCachePinAfterRestart(t *testing.T) {
+	sess, errDial := mgo.DialWithTimeout(mongoURL, time.Second)
+	if errDial != nil {
+		t.Skipf("MongoDB is not available, %s", errDial)
+	}
+	defer sess.Close()
+	_, cleanup := withTempStaticDir(t)
+	defer cleanup()
+
+	const videoID = "audiube-test-pinned"
+	defer sess.DB(dbName).C(audioCollectionName).RemoveAll(bson.M{"videoid": videoID})
+	if err := setPinned(sess, videoID, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(hlsProfileDirPath(videoID, "aac128"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(hlsProfileDirPath(videoID, "aac128"), "segment0000.ts"), make([]byte, 100), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// pins are restored without budget, and kept from eviction once a budget is set
+	restarted := &cacheManager{entries: make(map[string]*cacheEntry), pinned: make(map[string]bool)}
+	restarted.scan()
+	restarted.restorePins()
+	if stats := restarted.stats(); stats.PinnedVideos != 1 || stats.PinnedSize != 100 {
+		t.Errorf("pinned video should be restored, got %+v", stats)
+	}
+	restarted.budget = 1
+	if evicted := restarted.evict(); len(evicted) != 0 {
+		t.Errorf("pinned video should not be evicted after restart, got %v", evicted)
+	}
+}
@@ -6,7 +6,14 @@
 // =============================================
 //   - video id
 //   - video info (youtube.Video)
+//   - transcode profile
 //   - url to segment file of HLS
+//   - metadata of transcoded audio probed by ffprobe
+//   - loudness of audio measured with EBU R128
+//   - original and trimmed durations if silence is trimmed
+//   - stream selected to transcode and the reason
+//   - whether the video is pinned, i.e. never evicted from the streams cache
+// A video may have a document for each transcode profile.
 // =============================================
 //
 // A document in users collection may contain,
@@ -51,7 +58,13 @@ func init() {
 type videoDoc struct {
 	VideoID        string
 	VideoInfo      youtube.Video
+	Profile        string
 	SegmentFileURL string
+	Metadata       []*audioMetadata
+	Loudness       *loudnessInfo
+	Trim           *trimInfo
+	Stream         *selectedStream
+	Pinned         bool
 }
 
 type userDoc struct {
@@ -71,23 +84,23 @@ func getCollection(sess *mgo.Session, collectionName string) (*mgo.Collection, e
 	return sess.DB(dbName).C(collectionName), nil
 }
 
-// getSegmentListFileURLFromDB seeks a url for segment file in db.
+// getVideoDocFromDB seeks a document of videoID transcoded with profileName which has a url for segment file in db.
 // Error is returned if no entry is found.
-func getSegmentListFileURLFromDB(sess *mgo.Session, videoID string) (string, error) {
+func getVideoDocFromDB(sess *mgo.Session, videoID, profileName string) (*videoDoc, error) {
 	// search in the audio collection
 	var result videoDoc
 	if err := sess.DB(dbName).C(audioCollectionName).Find(
-		bson.M{"videoid": videoID, "segmentfileurl": bson.M{"$exists": true}},
+		bson.M{"videoid": videoID, "profile": profileName, "segmentfileurl": bson.M{"$exists": true}},
 	).One(&result); err != nil {
-		return "", fmt.Errorf("error occurred while searching segment list file url in db, %s", err) // error is returned if no document is found
+		return nil, fmt.Errorf("error occurred while searching segment list file url in db, %s", err) // error is returned if no document is found
 	}
-	return result.SegmentFileURL, nil
+	return &result, nil
 }
 
-// setSegmentListFileURL inserts or overwrites segment list file url of videoID
-func setSegmentListFileURL(sess *mgo.Session, videoID, fileURL string) error {
-	// insert only if document for videoID does not exist, otherwise, update only the url
-	searchQuery := bson.M{"videoid": videoID}
+// setSegmentListFileURL inserts or overwrites segment list file url of videoID transcoded with profileName
+func setSegmentListFileURL(sess *mgo.Session, videoID, profileName, fileURL string) error {
+	// insert only if document for videoID and profileName does not exist, otherwise, update only the url
+	searchQuery := bson.M{"videoid": videoID, "profile": profileName}
 	c := sess.DB(dbName).C(audioCollectionName) // audio collection
 	var res videoDoc
 	if err := c.Find(searchQuery).One(&res); err == nil {
@@ -95,11 +108,138 @@ func setSegmentListFileURL(sess *mgo.Session, videoID, fileURL string) error {
 		return c.Update(searchQuery, bson.M{"$set": bson.M{"segmentfileurl": fileURL}})
 	}
 
-	// no document found for videoID -> insert
+	// no document found for videoID and profileName -> insert
 	return c.Insert(&struct {
 		VideoID        string
+		Profile        string
 		SegmentFileURL string
-	}{VideoID: videoID, SegmentFileURL: fileURL})
+	}{VideoID: videoID, Profile: profileName, SegmentFileURL: fileURL})
+}
+
+// unsetSegmentListFileURL removes segment list file url of videoID transcoded with profileName, so that the stream is rebuilt on the next request
+func unsetSegmentListFileURL(sess *mgo.Session, videoID, profileName string) error {
+	_, err := sess.DB(dbName).C(audioCollectionName).UpdateAll(
+		bson.M{"videoid": videoID, "profile": profileName},
+		bson.M{"$unset": bson.M{"segmentfileurl": ""}},
+	)
+	return err
+}
+
+// unsetVideoSegmentListFileURLs removes segment list file urls of videoID transcoded with any profile
+func unsetVideoSegmentListFileURLs(sess *mgo.Session, videoID string) error {
+	_, err := sess.DB(dbName).C(audioCollectionName).UpdateAll(
+		bson.M{"videoid": videoID},
+		bson.M{"$unset": bson.M{"segmentfileurl": ""}},
+	)
+	return err
+}
+
+// setAudioMetadata inserts or overwrites metadata of audio of videoID transcoded with profileName
+func setAudioMetadata(sess *mgo.Session, videoID, profileName string, metadata []*audioMetadata) error {
+	_, err := sess.DB(dbName).C(audioCollectionName).Upsert(
+		bson.M{"videoid": videoID, "profile": profileName},
+		bson.M{"$set": bson.M{"metadata": metadata}},
+	)
+	return err
+}
+
+// setLoudness inserts or overwrites loudness of audio of videoID transcoded with profileName
+func setLoudness(sess *mgo.Session, videoID, profileName string, loudness *loudnessInfo) error {
+	_, err := sess.DB(dbName).C(audioCollectionName).Upsert(
+		bson.M{"videoid": videoID, "profile": profileName},
+		bson.M{"$set": bson.M{"loudness": loudness}},
+	)
+	return err
+}
+
+// setTrim inserts or overwrites how silence is trimmed from audio of videoID transcoded with profileName
+func setTrim(sess *mgo.Session, videoID, profileName string, trim *trimInfo) error {
+	_, err := sess.DB(dbName).C(audioCollectionName).Upsert(
+		bson.M{"videoid": videoID, "profile": profileName},
+		bson.M{"$set": bson.M{"trim": trim}},
+	)
+	return err
+}
+
+// setSelectedStream inserts or overwrites a stream selected to transcode videoID with profileName
+func setSelectedStream(sess *mgo.Session, videoID, profileName string, stream *selectedStream) error {
+	_, err := sess.DB(dbName).C(audioCollectionName).Upsert(
+		bson.M{"videoid": videoID, "profile": profileName},
+		bson.M{"$set": bson.M{"stream": stream}},
+	)
+	return err
+}
+
+// getTrimFromDB seeks how silence is trimmed from audio of videoID transcoded with profileName,
+// which is nil if silence is not trimmed. Error is returned if no entry is found.
+func getTrimFromDB(sess *mgo.Session, videoID, profileName string) (*trimInfo, error) {
+	var result videoDoc
+	if err := sess.DB(dbName).C(audioCollectionName).Find(
+		bson.M{"videoid": videoID, "profile": profileName},
+	).One(&result); err != nil {
+		return nil, fmt.Errorf("error occurred while searching trimming in db, %s", err)
+	}
+	return result.Trim, nil
+}
+
+// setVideoInfo overwrites video info of all documents of videoID,
+// and inserts a document of profileName if it does not exist yet, e.g. while the video is transcoded for the first time
+func setVideoInfo(sess *mgo.Session, videoID, profileName string, video *youtube.Video) error {
+	c := sess.DB(dbName).C(audioCollectionName)
+	if _, err := c.UpdateAll(bson.M{"videoid": videoID}, bson.M{"$set": bson.M{"videoinfo": video}}); err != nil {
+		return err
+	}
+	_, err := c.Upsert(bson.M{"videoid": videoID, "profile": profileName}, bson.M{"$set": bson.M{"videoinfo": video}})
+	return err
+}
+
+// getVideoInfoFromDB seeks video info of videoID saved with any profile.
+// Error is returned if no entry is found.
+func getVideoInfoFromDB(sess *mgo.Session, videoID string) (*youtube.Video, error) {
+	var result videoDoc
+	if err := sess.DB(dbName).C(audioCollectionName).Find(
+		bson.M{"videoid": videoID, "videoinfo.id": bson.M{"$exists": true, "$ne": ""}},
+	).One(&result); err != nil {
+		return nil, fmt.Errorf("error occurred while searching video info in db, %s", err)
+	}
+	return &result.VideoInfo, nil
+}
+
+// setPinned marks all documents of videoID as pinned or not.
+// A document is inserted if a video which has not been transcoded yet is pinned.
+func setPinned(sess *mgo.Session, videoID string, pinned bool) error {
+	c := sess.DB(dbName).C(audioCollectionName)
+	info, err := c.UpdateAll(bson.M{"videoid": videoID}, bson.M{"$set": bson.M{"pinned": pinned}})
+	if err != nil {
+		return err
+	}
+	if info.Matched == 0 && pinned {
+		return c.Insert(&struct {
+			VideoID string
+			Pinned  bool
+		}{VideoID: videoID, Pinned: true})
+	}
+	return nil
+}
+
+// getPinnedVideoIDs returns ids of pinned videos
+func getPinnedVideoIDs(sess *mgo.Session) ([]string, error) {
+	var videoIDs []string
+	if err := sess.DB(dbName).C(audioCollectionName).Find(bson.M{"pinned": true}).Distinct("videoid", &videoIDs); err != nil {
+		return nil, fmt.Errorf("error occurred while listing pinned videos in db, %s", err)
+	}
+	return videoIDs, nil
+}
+
+// getVideoDocsWithSegmentListFileURL returns all documents which have segment list file url
+func getVideoDocsWithSegmentListFileURL(sess *mgo.Session) ([]videoDoc, error) {
+	var docs []videoDoc
+	if err := sess.DB(dbName).C(audioCollectionName).Find(
+		bson.M{"segmentfileurl": bson.M{"$exists": true}},
+	).All(&docs); err != nil {
+		return nil, fmt.Errorf("error occurred while listing segment list file urls in db, %s", err)
+	}
+	return docs, nil
 }
 
 // withDB create a db session and register to a variable manager
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// contentDisposition builds Content-Disposition header to save a download file as an attachment.
+// filename falls back to ASCII videoID.extension for old clients, and filename* carries the title in UTF-8 if known.
+func contentDisposition(videoID, title string, profile *transcodeProfile) string {
+	d := fmt.Sprintf("attachment; filename=\"%s.%s\"", videoID, profile.Extension)
+	if title = strings.TrimSpace(title); title != "" {
+		// RFC 5987 percent encoding, where a space is %20 rather than +
+		d += "; filename*=UTF-8''" + strings.Replace(url.QueryEscape(title+"."+profile.Extension), "+", "%20", -1)
+	}
+	return d
+}
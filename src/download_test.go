@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFileArgs(t *testing.T) {
+	dir := "static"
+	originalStaticDirectory := staticDirectory
+	defer func() { staticDirectory = originalStaticDirectory }()
+	staticDirectory = &dir
+
+	profile, errLookup := lookupDownloadFormat("mp3")
+	if errLookup != nil {
+		t.Fatal(errLookup)
+	}
+	tags := &audioTags{values: map[string]string{"title": "Song A", "date": "2018"}}
+	args := strings.Join(fileArgs("abc", profile, &hlsInput{path: stdinInput}, tags), " ")
+	expected := "-y -i pipe:0 -vn -c:a libmp3lame -b:a 192k -metadata date=2018 -metadata title=Song A -id3v2_version 3 -f mp3 static/streams/abc/abc.mp3.part"
+	if args != expected {
+		t.Errorf("args expected %s, got %s", expected, args)
+	}
+
+	// cover art replaces video of the source
+	tags.coverPath = "static/streams/abc/cover.jpg"
+	args = strings.Join(fileArgs("abc", profile, &hlsInput{path: stdinInput}, tags), " ")
+	expected = "-y -i pipe:0 -i static/streams/abc/cover.jpg -map 0:a:0 -map 1:v:0 -c:v copy -disposition:v:0 attached_pic -metadata:s:v title=Album cover -metadata:s:v comment=Cover (front) -c:a libmp3lame"
+	if !strings.HasPrefix(args, expected) {
+		t.Errorf("args with cover art expected to start with %s, got %s", expected, args)
+	}
+
+	if _, err := lookupDownloadFormat("flac"); err == nil {
+		t.Error("unsupported format flac should return an error")
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	profile := downloadFormats["m4a"]
+	if d := contentDisposition("abc", "", profile); d != `attachment; filename="abc.m4a"` {
+		t.Errorf("disposition without title expected filename only, got %s", d)
+	}
+	expected := `attachment; filename="abc.m4a"; filename*=UTF-8''%E6%9B%B2%20A%2FB.m4a`
+	if d := contentDisposition("abc", "曲 A/B", profile); d != expected {
+		t.Errorf("disposition expected %s, got %s", expected, d)
+	}
+}
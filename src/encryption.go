@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	keyURIPrefix = "/keys/" // key of a video is served at /keys/:videoID
+	keySize      = 16       // bytes of an AES-128 key
+)
+
+// keyURIRegex matches a key url in #EXT-X-KEY of a segment list file and captures the escaped video id
+var keyURIRegex = regexp.MustCompile(`URI="` + keyURIPrefix + `([^"]+)"`)
+
+// prepareKey creates a key of a video unless it exists, and writes a key info file which tells FFmpeg the key and its url.
+// Every profile of a video shares the key.
+// It returns a path of the key info file.
+func prepareKey(videoID string) (string, error) {
+	if err := os.MkdirAll(*keysDirectory, 0700); err != nil {
+		return "", err
+	}
+
+	keyPath := keyFilePath(videoID)
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		key := make([]byte, keySize)
+		if _, err := rand.Read(key); err != nil {
+			return "", err
+		}
+		f, errTemp := ioutil.TempFile(*keysDirectory, "key")
+		if errTemp != nil {
+			return "", errTemp
+		}
+		defer os.Remove(f.Name())
+		_, errWrite := f.Write(key)
+		f.Close()
+		if errWrite != nil {
+			return "", errWrite
+		}
+		// link fails if a job for another profile has created the key meanwhile, which is used instead
+		if err := os.Link(f.Name(), keyPath); err != nil && !os.IsExist(err) {
+			return "", err
+		}
+	}
+
+	// the first line is the url written in #EXT-X-KEY, and the second is the key file FFmpeg reads
+	keyInfoPath := path.Join(*keysDirectory, videoID+".keyinfo")
+	if err := ioutil.WriteFile(keyInfoPath, []byte(hlsKeyURI(videoID)+"\n"+keyPath+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return keyInfoPath, nil
+}
+
+// localSegmentList returns a path of a segment list file which FFmpeg can read locally, and a function to remove it.
+// FFmpeg cannot fetch the key of an encrypted stream from its url, which is served only to listeners,
+// so a copy of the segment list file referring to the key file is made next to the original.
+func localSegmentList(segmentListFilePath string) (string, func(), error) {
+	noop := func() {}
+	b, err := ioutil.ReadFile(segmentListFilePath)
+	if err != nil {
+		return "", noop, err
+	}
+	if !keyURIRegex.Match(b) {
+		return segmentListFilePath, noop, nil
+	}
+
+	var errKey error
+	local := keyURIRegex.ReplaceAllFunc(b, func(uri []byte) []byte {
+		videoID, err := url.PathUnescape(string(keyURIRegex.FindSubmatch(uri)[1]))
+		if err != nil {
+			errKey = err
+			return uri
+		}
+		keyPath, err := filepath.Abs(keyFilePath(videoID))
+		if err != nil {
+			errKey = err
+			return uri
+		}
+		return []byte(`URI="` + keyPath + `"`)
+	})
+	if errKey != nil {
+		return "", noop, fmt.Errorf("failed to locate key of %s, %s", segmentListFilePath, errKey)
+	}
+
+	// segments are referred relatively, so the copy is in the same directory
+	f, errTemp := tempSegmentListFile(path.Dir(segmentListFilePath))
+	if errTemp != nil {
+		return "", noop, errTemp
+	}
+	_, errWrite := f.Write(local)
+	f.Close()
+	if errWrite != nil {
+		os.Remove(f.Name())
+		return "", noop, errWrite
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }, nil
+}
+
+// tempSegmentListFile creates a new file named local*.m3u8 in dir, since FFmpeg detects HLS by the extension.
+// ioutil.TempFile of Go 1.10 cannot put the random part before an extension.
+func tempSegmentListFile(dir string) (*os.File, error) {
+	for i := 0; i < 100; i++ {
+		random := make([]byte, 8)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path.Join(dir, "local"+hex.EncodeToString(random)+".m3u8"), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, fmt.Errorf("failed to create a temporary segment list file in %s", dir)
+}
+
+// hlsDemuxerOptions returns FFmpeg or ffprobe options put before an input file, which is HLS if its extension is m3u8.
+// A local segment list file refers to a key file, which the HLS demuxer refuses to open for its extension unless all extensions are allowed.
+// The options are not given to other inputs, since an option unknown to their demuxers is an error.
+func hlsDemuxerOptions(filePath string) []string {
+	if path.Ext(filePath) != ".m3u8" {
+		return nil
+	}
+	return []string{"-allowed_extensions", "ALL"}
+}
+
+// hlsKeyURI returns a url of the key of a video
+func hlsKeyURI(videoID string) string {
+	return keyURIPrefix + url.PathEscape(videoID) // /keys/videoID
+}
+
+// keyFilePath returns a path of the key of a video, which is out of static directory
+func keyFilePath(videoID string) string {
+	return path.Join(*keysDirectory, videoID+".key") // keys/videoID.key
+}
+
+// isStreamingFile reports whether a file under static/streams is a segment list file or a segment.
+// While streams are encrypted, only these are served as static files,
+// since download files, cover art and waveforms are not encrypted and would make the library public.
+func isStreamingFile(name string) bool {
+	switch path.Ext(name) {
+	case ".m3u8", ".ts", ".m4s":
+		return true
+	case ".mp4":
+		// init segment of fMP4, which has no audio samples
+		return strings.HasPrefix(path.Base(name), "init")
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrepareKey(t *testing.T) {
+	dir, errDir := ioutil.TempDir("", "audiube")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+	originalKeysDirectory := keysDirectory
+	defer func() { keysDirectory = originalKeysDirectory }()
+	keysDirectory = &dir
+
+	keyInfoFilePath, err := prepareKey("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, errRead := ioutil.ReadFile(keyFilePath("abc"))
+	if errRead != nil || len(key) != keySize {
+		t.Fatalf("key of %d bytes expected, got %v, %v", keySize, key, errRead)
+	}
+	expected := "/keys/abc\n" + path.Join(dir, "abc.key") + "\n"
+	if b, _ := ioutil.ReadFile(keyInfoFilePath); string(b) != expected {
+		t.Errorf("key info expected %q, got %q", expected, b)
+	}
+
+	// the key is kept for another profile
+	if _, err := prepareKey("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ioutil.ReadFile(keyFilePath("abc")); !bytes.Equal(key, again) {
+		t.Error("existing key should not be replaced")
+	}
+}
+
+func TestLocalSegmentList(t *testing.T) {
+	dir, errDir := ioutil.TempDir("", "audiube")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+	originalKeysDirectory := keysDirectory
+	defer func() { keysDirectory = originalKeysDirectory }()
+	keysDirectory = &dir
+
+	// unencrypted segment list file is used as it is
+	plain := path.Join(dir, "plain.m3u8")
+	ioutil.WriteFile(plain, []byte("#EXTM3U\n#EXTINF:10.0,\nsegment0000.ts\n"), 0666)
+	local, cleanup, err := localSegmentList(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	if local != plain {
+		t.Errorf("unencrypted segment list file expected %s, got %s", plain, local)
+	}
+
+	encrypted := path.Join(dir, "audio.m3u8")
+	ioutil.WriteFile(encrypted, []byte("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/abc\"\n#EXTINF:10.0,\nsegment0000.ts\n"), 0666)
+	local, cleanup, err = localSegmentList(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath, _ := filepath.Abs(keyFilePath("abc"))
+	if b, _ := ioutil.ReadFile(local); !strings.Contains(string(b), `URI="`+keyPath+`"`) || path.Dir(local) != dir || path.Ext(local) != ".m3u8" {
+		t.Errorf("copy next to the original referring to %s expected, got %s in %s", keyPath, b, local)
+	}
+	cleanup()
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Errorf("copy should be removed, %v", err)
+	}
+}
+
+func TestIsStreamingFile(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"streams/abc/aac128/audio.m3u8":        true,
+		"streams/abc/aac128/segment0000.ts":    true,
+		"streams/abc/aac128/segment0000.m4s":   true,
+		"streams/abc/abr/aac64/init_aac64.mp4": true,
+		"streams/abc/abc.m4a":                  false,
+		"streams/abc/cover.jpg":                false,
+		"streams/abc/aac128/waveform.json":     false,
+	} {
+		if isStreamingFile(name) != expected {
+			t.Errorf("%s should be served while encrypted: %t", name, expected)
+		}
+	}
+}
+
+func TestHLSDemuxerOptions(t *testing.T) {
+	if options := strings.Join(hlsDemuxerOptions("static/streams/abc/aac128/local0123.m3u8"), " "); options != "-allowed_extensions ALL" {
+		t.Errorf("segment list file should be read with all extensions allowed, got %s", options)
+	}
+	if options := hlsDemuxerOptions("/tmp/audiube-abc-0123"); len(options) != 0 {
+		t.Errorf("source file should be read without options, got %v", options)
+	}
+}
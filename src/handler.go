@@ -5,10 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,7 +22,11 @@ import (
 
 const (
 	segmentListFilename = "audio.m3u8"
+	masterListFilename  = "master.m3u8"
 	segmentFilename     = "segment%04d.ts"
+	fmp4SegmentFilename = "segment%04d.m4s"
+	fmp4InitFilename    = "init.mp4"
+	seekDirName         = "seek" // seek streams of a video are saved in static/streams/:videoID/seek
 )
 
 // handleWithLogging wraps a handler
@@ -37,6 +45,32 @@ func allowCORS(f http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// credentialedOrigins are origins of players on other sites given by -allowed-origins, which may send cookies of sessions
+var credentialedOrigins = make(map[string]bool)
+
+// allowCredentialedCORS allows request with cookies, which carry sessions of listeners, only from credentialedOrigins.
+// Any other site would read keys and downloads with cookies of a listener visiting it, so no CORS header is sent to it.
+// Preflight requests, e.g. for POST with json or DELETE, are answered here.
+func allowCredentialedCORS(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		allowed := credentialedOrigins[r.Header.Get("Origin")]
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == http.MethodOptions {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		f(w, r)
+	}
+}
+
 // GET /
 // index.html <- single page driven by React
 // indexHandler provides index page
@@ -66,6 +100,8 @@ func setContentTypeJSON(f http.HandlerFunc) http.HandlerFunc {
 
 // GET /static/hoge
 // Desc: static files such as css and js are placed under static directory and obtained through this handler
+// While streams are encrypted, files under static/streams except segment list files and segments are not served.
+// A segment list file of a whole stream is filled with seek streams transcoded ahead of it.
 // staticFileHandler provides filename under static directory for /filename request
 // TODO: make a wrapper to alter segment list files
 func staticFileHandler(w http.ResponseWriter, r *http.Request) {
@@ -75,44 +111,98 @@ func staticFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	filePath := path.Join(*staticDirectory, requestPath.id)
 	logger.Print("static file path ", filePath)
-
-	f, errOpen := os.Open(filePath)
-	if errOpen != nil {
-		http.Error(w, errOpen.Error(), http.StatusInternalServerError)
+	names := strings.Split(strings.TrimPrefix(path.Clean("/"+requestPath.id), "/"), "/")
+	if names[0] == "streams" && jManager.encrypt && !isStreamingFile(requestPath.id) {
+		// unencrypted files of videos are served only to listeners, e.g. by /downloads
+		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-	defer f.Close()
-
-	w.Header().Set("Content-Type", name2ContentType(requestPath.id))
+	if len(names) > 2 && names[0] == "streams" {
+		// playing segments keeps the video in the cache
+		cManager.touch(names[1])
+	}
 
 	if filepath.Ext(filePath) == ".m3u8" {
-		// if a request is for segment list file (.m3u8), insert "#EXT-X-START:0\n"
-		buf := new(bytes.Buffer)
-		if _, err := buf.ReadFrom(f); err != nil {
-			http.Error(w, "failed reading to []byte, "+err.Error(), http.StatusInternalServerError)
+		// if a request is for segment list file (.m3u8), tell players its type and where to start
+		list, errRead := ioutil.ReadFile(filePath)
+		if len(names) > 3 && names[0] == "streams" {
+			// the whole stream may not exist yet where seek streams have been transcoded
+			list, errRead = filledSegmentList(names[1], names[2], path.Join(names[3:]...), list, errRead)
+		}
+		if errRead != nil {
+			http.Error(w, errRead.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// insert "#EXT-X-START:0\n" after "#EXTM3U\n"
-		originalList := buf.Bytes()
-		startInstruction := []byte("#EXT-X-START:0\n")
-		insertedList := make([]byte, 0, len(originalList)+len(startInstruction))
-		insertedList = append(insertedList, originalList[:8]...) // len("#EXTM3U\n") = 8
-		insertedList = append(insertedList, startInstruction...)
-		insertedList = append(insertedList, originalList[8:]...)
-
+		w.Header().Set("Content-Type", name2ContentType(requestPath.id))
+		insertedList, complete := servedSegmentList(list)
+		if !complete {
+			// players and proxies must fetch a growing list again
+			w.Header().Set("Cache-Control", "no-cache")
+		}
 		if _, err := w.Write(insertedList); err != nil {
 			http.Error(w, "failed writing to ResponseWriter, "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	f, errOpen := os.Open(filePath)
+	if errOpen != nil {
+		http.Error(w, errOpen.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", name2ContentType(requestPath.id))
+	// segments are served with Range support, which players may use for fMP4
+	info, errStat := f.Stat()
+	if errStat != nil {
+		http.Error(w, errStat.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, filePath, info.ModTime(), f)
+}
+
+// servedSegmentList rewrites a segment list file for players, and reports whether it is complete.
+// A segment list file being written by FFmpeg is served as an EVENT playlist, which players keep polling as it grows,
+// and a complete one with #EXT-X-ENDLIST is served as a VOD playlist.
+// Playback starts from the beginning rather than the live edge unless the list designates where to start, e.g. a track,
+// and the version is raised for the start if needed.
+// A master playlist is served as it is.
+func servedSegmentList(list []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(list, []byte("#EXTM3U\n")) || bytes.Contains(list, []byte("#EXT-X-STREAM-INF")) {
+		return list, true
+	}
+	complete := bytes.Contains(list, []byte("#EXT-X-ENDLIST"))
+
+	// tags are inserted after "#EXTM3U\n"
+	served := new(bytes.Buffer)
+	served.WriteString("#EXTM3U\n")
+	if complete {
+		served.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
 	} else {
-		if _, err := io.Copy(w, f); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		served.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	}
+	insertStart := !bytes.Contains(list, []byte("#EXT-X-START"))
+	if insertStart {
+		// EXT-X-START requires version 6, while a merged list of seek streams may have a higher one
+		version := 6
+		for _, line := range bytes.Split(list, []byte("\n")) {
+			if v, err := strconv.Atoi(string(bytes.TrimPrefix(line, []byte("#EXT-X-VERSION:")))); err == nil && v > version {
+				version = v
+			}
 		}
+		fmt.Fprintf(served, "#EXT-X-START:TIME-OFFSET=0\n#EXT-X-VERSION:%d\n", version)
 	}
-
-	w.WriteHeader(http.StatusOK)
+	for _, line := range bytes.SplitAfter(list[len("#EXTM3U\n"):], []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("#EXT-X-PLAYLIST-TYPE")) || insertStart && bytes.HasPrefix(line, []byte("#EXT-X-VERSION")) {
+			continue
+		}
+		served.Write(line)
+	}
+	return served.Bytes(), complete
 }
 
 // ====================================================================================================
@@ -147,6 +237,7 @@ func videosHandler(w http.ResponseWriter, r *http.Request) {
 // 		{
 // 			"id": "a30jvlkjs03",
 // 			"title": "hoge",
+// 			"channel": "fuga",
 // 			"duration": "PT1H43M31S",
 // 			"view_count": "136421",
 // 			"publish_date": "2018-03-29",
@@ -216,6 +307,7 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 // 		{
 // 			"id": "alskjeo93-s",
 // 			"title": "hoge",
+// 			"channel": "fuga",
 // 			"duration": "PT1H43M31S",
 // 			"view_count": "136421",
 // 			"publish_date": "2018-03-29",
@@ -279,6 +371,7 @@ func relatedSearchHandler(w http.ResponseWriter, r *http.Request) {
 // {
 // 	"id": "a30jvlkjs03",
 // 	"title": "hoge",
+// 	"channel": "fuga",
 // 	"duration": "PT1H43M31S",
 // 	"view_count": "136421",
 // 	"publish_date": "2018-03-29",
@@ -326,21 +419,59 @@ func videoGetHandler(w http.ResponseWriter, r *http.Request) {
 // GET /streams/:id
 // {
 // 	"id": "a30jvlkjs03",
-// 	"segment_list_file_url": "/.../a30jvlkjs03/audio.m3u8",  <- relative path from index url
+// 	"segment_list_file_url": "/.../a30jvlkjs03/abr/master.m3u8",  <- relative path from index url
+// 	"profile": "abr",
+// 	"state": "queued",  <- one of queued, downloading, transcoding, done
+// 	"queue_position": 3,  <- 1-based position in a queue for download or FFmpeg, only if state is queued
+// 	"metadata": [  <- properties of transcoded audio probed by ffprobe, one for each rendition, only if state is done
+// 		{"rendition": "aac64", "duration": 212.3, "codec": "aac", "bitrate": 64, "sample_rate": 44100, "channels": 2, "channel_layout": "stereo"},
+// 		...
+// 	],
+// 	"loudness": {  <- only if loudness is measured, see -loudness option
+// 		"integrated_loudness": -9.8,  <- LUFS of the source
+// 		"true_peak": 0.4,
+// 		"loudness_range": 6.1,
+// 		"normalized": true,  <- true if the served audio is normalized to target_loudness
+// 		"target_loudness": -16,
+// 		"replay_gain": -2  <- dB to adjust the served audio to -18 LUFS
+// 	},
+// 	"trim": {  <- only if silence is trimmed, see -trim-silence option
+// 		"original_duration": 245.2,
+// 		"trimmed_duration": 212.3,
+// 		"start": 3.4,  <- position in the original audio where the served audio starts
+// 		"end": 215.7
+// 	},
+// 	"tracks": [  <- only if the description of the video has chapters, e.g. a full album
+// 		{"title": "Main theme", "start": 0, "end": 137, "segment_list_file_url": "/.../a30jvlkjs03/abr/master_track01.m3u8"},
+// 		...  <- start and end are seconds in the whole stream, each segment list file plays only the track
+// 	]
 // }
+// A waveform of the audio is served by /streams/:id/waveform.
 //
 // streamHandler respond to a stream request, i.e. request for HLS segment file
-// URL is something like "static/streams/:videoID/audio.m3u8", since the program servers contents under static directory if requested.
+// URL is something like "static/streams/:videoID/:profile/audio.m3u8", since the program servers contents under static directory if requested.
+// For an adaptive profile such as abr, which is the default, URL is of a master playlist "static/streams/:videoID/:profile/master.m3u8".
 // Embedding this url into video tag works.
-// 3 cases to deal with,
+// While transcoding, the segment list file is served as an EVENT playlist, so playback starts with the first segments and follows the rest.
+// 4 cases to deal with,
 //   * segment file url of a given video id exists in db -> respond with the url
+//   * a transcode job for the video id is in progress -> wait for the segment list file and respond with the url
 //   * segment file url not in db but has already been created in the streams folder -> build url and respond with it, as well as registering it on db
-//   * segment file has not been created -> download video, convert it using FFmpeg to HLS, respond with the url as soon as segment file (.m3u8) is created, and register the url on db
+//   * segment file has not been created -> start a transcode job which downloads video and converts it using FFmpeg to HLS, respond with the url as soon as segment list file (.m3u8) is created, and register the url on db
+// Audio is encoded with a profile given by query param profile, e.g. ?profile=opus, or the server default profile if omitted.
+// Concurrent requests for the same video id and profile share a single transcode job.
+// Query param prefetch=1 starts a job with lower priority than a user play, which is useful to prepare a next track in background.
+// If the segment list file is not created within stream-wait, 202 Accepted is returned with status_url to poll.
+// If the job has failed, the error is returned once and the next request retries.
+// Query param start=5400 asks for playback from 5400 seconds, and the player seeks to the position in the returned stream.
+// If the whole stream has not reached there, a seek stream is transcoded from the position prior to the whole stream,
+// which goes on as a prefetch, and the segment list file of the whole stream is served with segments of the seek stream
+// and gaps before them, which are filled as the whole stream grows (see seek.go).
+// 409 Conflict is returned instead if the source cannot seek, e.g. YouTube streams downloaded only from the beginning by gotube,
+// or silence trimming or loudness normalization is enabled, which needs the whole source.
 // This handler is supposed to be wraped by withVars and withDB.
 func streamsHandler(w http.ResponseWriter, r *http.Request) {
 	// TODO: path parsing should be done by a wrapper
-	// TODO: graceful shutdown
-	// TODO: stop and delete unsuccessful vedeo download
 	// get video id from request path
 	pp, errParse := parsePath(r.URL.String())
 	if errParse != nil {
@@ -351,48 +482,119 @@ func streamsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "id empty", http.StatusBadRequest)
 		return
 	}
-
-	// define response body json format
-	// {
-	// 	id: %s,
-	// 	segment_list_file_url: %s
-	// }
-	resultFormat := ("{\"id\":\"%s\",\"segment_list_file_url\":\"%s\"}")
+	profile, errProfile := requestedProfile(pp)
+	if errProfile != nil {
+		http.Error(w, errProfile.Error(), http.StatusBadRequest)
+		return
+	}
+	start, errStart := requestedStart(pp)
+	if errStart != nil {
+		http.Error(w, errStart.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.HasSuffix(pp.id, streamStatusSuffix) {
+		// /streams/:id/status
+		streamStatusHandler(w, r, strings.TrimSuffix(pp.id, streamStatusSuffix), profile, start)
+		return
+	}
+	if strings.HasSuffix(pp.id, streamWaveformSuffix) {
+		// /streams/:id/waveform
+		streamWaveformHandler(w, r, strings.TrimSuffix(pp.id, streamWaveformSuffix), profile)
+		return
+	}
+	if strings.HasSuffix(pp.id, streamPinSuffix) {
+		// /streams/:id/pin
+		videoID := strings.TrimSuffix(pp.id, streamPinSuffix)
+		if r.Method == http.MethodOptions {
+			// preflight does not carry the admin token, which is checked on the actual request
+			w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", adminTokenHeader)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		withAdmin(func(w http.ResponseWriter, r *http.Request) {
+			streamPinHandler(w, r, videoID)
+		})(w, r)
+		return
+	}
+	cManager.touch(pp.id)
 
 	// segment file exists and respond to the request with it
 	if dbSess, ok := vManager.get(r, dbSessionKey).(*mgo.Session); ok {
 		// got session
-		if fileURL, err := getSegmentListFileURLFromDB(dbSess, pp.id); err == nil {
+		if doc, err := getVideoDocFromDB(dbSess, pp.id, profile.Name); err == nil {
 			// got url for segment list file
-			if _, err := io.Copy(w, strings.NewReader(fmt.Sprintf(resultFormat, pp.id, fileURL))); err == nil {
-				// writing done
-				w.WriteHeader(http.StatusOK)
+			metadata := doc.Metadata
+			if metadata == nil {
+				metadata = probeAndSaveMetadata(r, pp.id, profile)
+			}
+			var video *youtube.Video
+			if doc.VideoInfo.ID != "" {
+				video = &doc.VideoInfo
+			}
+			tracks := streamTracks(r, pp.id, profile, video, doc.Trim)
+			writeStreamResponse(w, &streamResponse{ID: pp.id, SegmentListFileURL: doc.SegmentFileURL, Profile: profile.Name, State: jobDone.String(), Metadata: metadata, Loudness: doc.Loudness, Trim: doc.Trim, Tracks: tracks}, http.StatusOK)
+			return
+		}
+	}
+
+	// a position which the whole stream has not reached yet is served by a seek stream if the source can seek,
+	// otherwise seeking would download the source from the beginning again
+	if start > 0 && !isCompleteStream(pp.id, profile.Name) {
+		if job := jManager.get(pp.id, profile); job == nil || listedDuration(job.renditionSegmentListFilePaths()[0]) < start {
+			if !canSeek() {
+				http.Error(w, fmt.Sprintf("%s has not been transcoded until %ds and its source cannot seek, request it without start", pp.id, start/time.Second), http.StatusConflict)
 				return
 			}
-			// failed writing
-			http.Error(
-				w,
-				fmt.Sprintf("error while writing url into response writer, %s", err),
-				http.StatusInternalServerError,
-			)
+			seekStreamHandler(w, r, pp, profile, start)
+			return
+		}
+	}
+
+	// a job for the video id is in progress
+	if job := jManager.get(pp.id, profile); job != nil {
+		state, errJob := job.status()
+		switch state {
+		case jobFailed:
+			// report the failure only once, next request will retry
+			jManager.remove(job)
+			http.Error(w, fmt.Sprintf("transcode for %s failed, %s", pp.id, errJob), http.StatusInternalServerError)
+			return
+		case jobDone:
+			// fall through to search in static/streams directory
+		default:
+			if pp.params == nil || pp.params.Get("prefetch") == "" {
+				// a user has come to listen to a prefetched video
+				jManager.promote(job, priorityPlay)
+			}
+			waitJobAndRespond(w, r, job)
 			return
 		}
 	}
 
 	// search in static/streams directory
-	// segment list file and video segments are stored in a directory whose name is a video id
-	segmentListFilePath := path.Join(hlsSaveDirPath(pp.id), segmentListFilename)
-	if _, err := os.Stat(segmentListFilePath); !os.IsNotExist(err) {
+	// segment list file and video segments are stored in a directory whose name is a profile under a directory whose name is a video id
+	// a segment list file left by an interrupted transcode is not complete and is rebuilt
+	segmentListFilePath := hlsSegmentListFilePath(pp.id, profile.Name)
+	if isCompleteStream(pp.id, profile.Name) {
 		// segment list file for videoID exists
 		// respond with the url
-		if _, err := io.Copy(w, strings.NewReader(fmt.Sprintf(resultFormat, pp.id, segmentListFilePath))); err != nil {
-			http.Error(w, "error while writing url into response writer, "+err.Error(), http.StatusInternalServerError)
+		metadata := probeAndSaveMetadata(r, pp.id, profile)
+		// tracks are shifted by trimmed silence, which is known to a finished job or saved in db without the url
+		var trim *trimInfo
+		if job := jManager.get(pp.id, profile); job != nil {
+			trim = job.getTrim()
+		} else if sess, ok := vManager.get(r, dbSessionKey).(*mgo.Session); ok {
+			if t, err := getTrimFromDB(sess, pp.id, profile.Name); err == nil {
+				trim = t
+			}
 		}
-		w.WriteHeader(http.StatusOK)
+		tracks := streamTracks(r, pp.id, profile, nil, trim)
+		writeStreamResponse(w, &streamResponse{ID: pp.id, SegmentListFileURL: segmentListFilePath, Profile: profile.Name, State: jobDone.String(), Metadata: metadata, Trim: trim, Tracks: tracks}, http.StatusOK)
 
 		// register the url on db
 		if sess, ok := vManager.get(r, dbSessionKey).(*mgo.Session); ok {
-			if err := setSegmentListFileURL(sess, pp.id, segmentListFilePath); err != nil {
+			if err := setSegmentListFileURL(sess, pp.id, profile.Name, segmentListFilePath); err != nil {
 				logger.Printf("error while registering new segment list file url on db, %s", err)
 			}
 		}
@@ -402,19 +604,610 @@ func streamsHandler(w http.ResponseWriter, r *http.Request) {
 	// download video, transcode with FFmpeg, and respond with a newly created segment list file url
 	// download: use chunk fetch (goroutine)
 	// FFmpeg: successively start transcoding from fetch data (goroutine)
-	// respond: receive message from a goroutine where transcoding runs, respond to request and register segment list file url to db
-	var errFetch error
-	segmentListFilePath, errFetch = fetchVideAndBuildHLS(pp.id) // errorChannel notify result of transcode conducted in another goroutine
-	if errFetch != nil {
-		http.Error(w, errFetch.Error(), http.StatusInternalServerError)
+	// respond: wait until the segment list file is created and respond with its url; registration on DB will be done in next call for this video id
+	priority := priorityPlay
+	if pp.params != nil && pp.params.Get("prefetch") != "" {
+		priority = priorityPrefetch
+	}
+	job, _ := jManager.start(pp.id, profile, priority)
+	waitJobAndRespond(w, r, job)
+}
+
+// seekStreamHandler transcodes a seek stream of a video from start, and responds with a url of the whole stream
+// as soon as the seek stream becomes playable. The whole stream is started as a prefetch after the seek stream,
+// so that it fills the rest in background. A seek stream is not registered on db,
+// and remains until the video is evicted or the server restarts.
+func seekStreamHandler(w http.ResponseWriter, r *http.Request, pp *parsedPath, profile *transcodeProfile, start time.Duration) {
+	if isCompleteSeekStream(pp.id, profile, start) {
+		jManager.start(pp.id, profile, priorityPrefetch)
+		writeStreamResponse(w, &streamResponse{ID: pp.id, SegmentListFileURL: hlsSegmentListFilePath(pp.id, profile.Name), Profile: profile.Name, State: jobDone.String()}, http.StatusOK)
+		return
+	}
+
+	priority := priorityPlay
+	if pp.params.Get("prefetch") != "" {
+		priority = priorityPrefetch
+	}
+	job, _ := jManager.startAt(pp.id, profile, priority, start)
+	jManager.start(pp.id, profile, priorityPrefetch)
+	waitJobAndRespond(w, r, job)
+}
+
+// waitJobAndRespond waits until the segment list file of job becomes playable at most stream-wait and responds with its url.
+// On timeout, 202 Accepted is returned with a url to poll the job status.
+// If the client goes away before the job gets ready and no other request is waiting for it, the job is canceled.
+func waitJobAndRespond(w http.ResponseWriter, r *http.Request, job *transcodeJob) {
+	timer := time.NewTimer(*streamWaitTimeout)
+	defer timer.Stop()
+
+	job.attach()
+	abandoned := false
+	defer func() { job.detach(abandoned) }()
+
+	select {
+	case <-job.ready:
+		state, _ := job.status()
+		writeStreamResponse(w, &streamResponse{ID: job.videoID, SegmentListFileURL: job.segmentListFilePath, Profile: job.profile.Name, State: state.String()}, http.StatusOK)
+	case <-job.done:
+		// a successful job is also ready, which select may not have picked
+		state, errJob := job.status()
+		if state == jobDone {
+			writeStreamResponse(w, &streamResponse{ID: job.videoID, SegmentListFileURL: job.segmentListFilePath, Profile: job.profile.Name, State: state.String()}, http.StatusOK)
+			return
+		}
+		jManager.remove(job)
+		http.Error(w, fmt.Sprintf("transcode for %s failed, %s", job.videoID, errJob), http.StatusInternalServerError)
+	case <-timer.C:
+		state, _ := job.status()
+		writeStreamResponse(w, &streamResponse{
+			ID:                 job.videoID,
+			SegmentListFileURL: job.segmentListFilePath,
+			Profile:            job.profile.Name,
+			State:              state.String(),
+			QueuePosition:      jManager.queuePosition(job),
+			StatusURL:          seekStreamStatusURL(job.videoID, job.profile.Name, job.start),
+		}, http.StatusAccepted)
+	case <-r.Context().Done():
+		// client has gone
+		abandoned = true
+	}
+}
+
+// GET /streams/:id/status?profile=aac128
+// {
+// 	"id": "a30jvlkjs03",
+// 	"segment_list_file_url": "/.../a30jvlkjs03/aac128/audio.m3u8",
+// 	"profile": "aac128",
+// 	"state": "transcoding",
+// 	"queue_position": 3,  <- only if state is queued
+// 	"ready": false,  <- true if the segment list file is playable
+// 	"error": "...",  <- set only if state is failed
+// 	"stream": {  <- stream selected to transcode, saved in db when the job is done
+// 		"format": "mp4",
+// 		"media_type": "audio",
+// 		"resolution": "",
+// 		"codec": "mp4a.40.2",
+// 		"bitrate": 128,
+// 		"sample_rate": 44100,
+// 		"reason": "container mp4 is preference #1, audio stream under prefer-audio, 6 of 6 streams passed filters",
+// 	},
+// 	"metadata": [...]  <- same as /streams/:id, only if state is done
+// }
+// streamStatusHandler reports progress of a transcode job without waiting or starting a new job.
+// With start, a job of a seek stream is reported, or the whole stream if the seek stream is not found.
+// 404 is returned if neither a job nor a segment list file exists for the video id and profile.
+func streamStatusHandler(w http.ResponseWriter, r *http.Request, videoID string, profile *transcodeProfile, start time.Duration) {
+	if job := jManager.getAt(videoID, profile, start); job != nil {
+		state, errJob := job.status()
+		resp := &streamResponse{ID: videoID, SegmentListFileURL: job.segmentListFilePath, Profile: profile.Name, State: state.String(), QueuePosition: jManager.queuePosition(job)}
+		select {
+		case <-job.ready:
+			resp.Ready = true
+		default:
+		}
+		if errJob != nil {
+			resp.Error = errJob.Error()
+		}
+		resp.Metadata = job.getMetadata()
+		resp.Loudness = job.getLoudness()
+		resp.Trim = job.getTrim()
+		resp.Stream = newSelectedStream(job.selection())
+		writeStreamResponse(w, resp, http.StatusOK)
+		return
+	}
+	if start > 0 && isCompleteSeekStream(videoID, profile, start) {
+		writeStreamResponse(w, &streamResponse{ID: videoID, SegmentListFileURL: hlsSegmentListFilePath(videoID, profile.Name), Profile: profile.Name, State: jobDone.String(), Ready: true}, http.StatusOK)
+		return
+	}
+
+	segmentListFilePath := hlsSegmentListFilePath(videoID, profile.Name)
+	if isCompleteStream(videoID, profile.Name) {
+		var metadata []*audioMetadata
+		var loudness *loudnessInfo
+		var trim *trimInfo
+		var stream *selectedStream
+		if sess, ok := vManager.get(r, dbSessionKey).(*mgo.Session); ok {
+			if doc, err := getVideoDocFromDB(sess, videoID, profile.Name); err == nil {
+				metadata, loudness, trim, stream = doc.Metadata, doc.Loudness, doc.Trim, doc.Stream
+			}
+		}
+		if metadata == nil {
+			metadata = probeAndSaveMetadata(r, videoID, profile)
+		}
+		writeStreamResponse(w, &streamResponse{ID: videoID, SegmentListFileURL: segmentListFilePath, Profile: profile.Name, State: jobDone.String(), Ready: true, Stream: stream, Metadata: metadata, Loudness: loudness, Trim: trim}, http.StatusOK)
+		return
+	}
+	http.Error(w, fmt.Sprintf("no stream for %s", videoID), http.StatusNotFound)
+}
+
+const streamStatusSuffix = "/status"
+
+// GET /streams/:id/waveform?profile=aac128
+// {
+// 	"resolution": 10,  <- peaks per second, see -waveform-resolution option
+// 	"duration": 212.3,
+// 	"peaks": [0, 12, 87, 255, 240, ...]  <- maximum amplitude of each 1/resolution seconds, 255 is full scale
+// }
+// streamWaveformHandler responds with a waveform of transcoded audio for a seek bar.
+// The waveform is generated after transcoding, and generated on demand for a stream built before,
+// which waits for a worker of FFmpeg like a transcode.
+// While a job is in progress, 202 Accepted is returned with the job status as /streams/:id/status.
+// 404 is returned if neither a job nor a complete stream exists for the video id and profile.
+func streamWaveformHandler(w http.ResponseWriter, r *http.Request, videoID string, profile *transcodeProfile) {
+	waveformFilePath := hlsWaveformFilePath(videoID, profile.Name)
+	if f, err := os.Open(waveformFilePath); err == nil {
+		defer f.Close()
+		if info, errStat := f.Stat(); errStat == nil {
+			http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+			return
+		}
+	}
+
+	if job := jManager.get(videoID, profile); job != nil {
+		state, errJob := job.status()
+		resp := &streamResponse{ID: videoID, SegmentListFileURL: job.segmentListFilePath, Profile: profile.Name, State: state.String(), QueuePosition: jManager.queuePosition(job), StatusURL: streamStatusURL(videoID, profile.Name)}
+		if errJob != nil {
+			resp.Error = errJob.Error()
+		}
+		writeStreamResponse(w, resp, http.StatusAccepted)
+		return
+	}
+
+	if !isCompleteStream(videoID, profile.Name) {
+		http.Error(w, fmt.Sprintf("no stream for %s", videoID), http.StatusNotFound)
+		return
+	}
+	if err := jManager.generateWaveformOf(r.Context(), videoID, profile); err != nil {
+		http.Error(w, fmt.Sprintf("failed to generate waveform of %s, %s", videoID, err), http.StatusInternalServerError)
+		return
+	}
+	http.ServeFile(w, r, waveformFilePath)
+}
+
+const streamWaveformSuffix = "/waveform"
+
+// POST /streams/:id/pin
+// {
+// 	"id": "a30jvlkjs03",
+// 	"pinned": true,
+// 	"size": 10485760  <- bytes of files of the video on disk, 0 if not transcoded yet
+// }
+// DELETE /streams/:id/pin unpins the video and responds likewise.
+// Both require the admin token in X-Admin-Token header.
+// streamPinHandler pins a video so that eviction never removes its files of any profile, or unpins it.
+// A video can be pinned before it is transcoded. Pins are saved in db, so that they survive restarts.
+func streamPinHandler(w http.ResponseWriter, r *http.Request, videoID string) {
+	var pinned bool
+	switch r.Method {
+	case http.MethodPost:
+		pinned = true
+	case http.MethodDelete:
+	default:
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	sess, ok := vManager.get(r, dbSessionKey).(*mgo.Session)
+	if !ok {
+		http.Error(w, "failed to connect to db, plz contact admin", http.StatusInternalServerError)
+		return
+	}
+
+	// pinned in memory first, not to be evicted while saving it
+	cManager.pin(videoID, pinned)
+	if err := setPinned(sess, videoID, pinned); err != nil {
+		cManager.pin(videoID, !pinned)
+		http.Error(w, fmt.Sprintf("failed to save pin of %s, %s", videoID, err), http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		ID     string `json:"id"`
+		Pinned bool   `json:"pinned"`
+		Size   int64  `json:"size"`
+	}{ID: videoID, Pinned: pinned, Size: cManager.size(videoID)}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Printf("failed to write result into ResponseWriter, %s", err)
+	}
+}
+
+const streamPinSuffix = "/pin"
+
+// streamStatusURL builds a url to poll a job status for videoID and profile
+func streamStatusURL(videoID, profileName string) string {
+	return "/streams/" + videoID + streamStatusSuffix + "?profile=" + url.QueryEscape(profileName)
+}
+
+// seekStreamStatusURL is the same as streamStatusURL for a job of a seek stream starting at start
+func seekStreamStatusURL(videoID, profileName string, start time.Duration) string {
+	if start > 0 {
+		return streamStatusURL(videoID, profileName) + "&start=" + strconv.FormatInt(int64(start/time.Second), 10)
+	}
+	return streamStatusURL(videoID, profileName)
+}
+
+// seekStep is granularity of a position where a seek stream starts, which is the duration of a segment,
+// so that requests for nearby positions share a seek stream
+const seekStep = 10 * time.Second
+
+// requestedStart returns a position in seconds designated by query param start rounded down to seekStep, or 0 if omitted
+func requestedStart(pp *parsedPath) (time.Duration, error) {
+	if pp.params == nil || pp.params.Get("start") == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseFloat(pp.params.Get("start"), 64)
+	if err != nil || math.IsNaN(seconds) || seconds < 0 || seconds > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid start %s, seconds from the beginning required", pp.params.Get("start"))
+	}
+	start := time.Duration(seconds * float64(time.Second))
+	return start - start%seekStep, nil
+}
+
+// requestedProfile returns a profile designated by query param profile, or the default profile if omitted
+func requestedProfile(pp *parsedPath) (*transcodeProfile, error) {
+	if pp.params != nil && pp.params.Get("profile") != "" {
+		return lookupProfile(pp.params.Get("profile"))
 	}
+	return lookupProfile(*defaultProfile)
+}
+
+// streamResponse is a response body format of /streams/:id and /streams/:id/status
+type streamResponse struct {
+	ID                 string           `json:"id"`
+	SegmentListFileURL string           `json:"segment_list_file_url"`
+	Profile            string           `json:"profile"`
+	State              string           `json:"state"`
+	QueuePosition      int              `json:"queue_position,omitempty"`
+	Ready              bool             `json:"ready,omitempty"`
+	StatusURL          string           `json:"status_url,omitempty"`
+	Error              string           `json:"error,omitempty"`
+	Stream             *selectedStream  `json:"stream,omitempty"`
+	Metadata           []*audioMetadata `json:"metadata,omitempty"`
+	Loudness           *loudnessInfo    `json:"loudness,omitempty"`
+	Trim               *trimInfo        `json:"trim,omitempty"`
+	Tracks             []*track         `json:"tracks,omitempty"`
+}
+
+// selectedStream describes a stream selected by a transcode job and why, which is also saved in db
+type selectedStream struct {
+	Format     string `json:"format"`
+	MediaType  string `json:"media_type"`
+	Resolution string `json:"resolution"`
+	Codec      string `json:"codec"`
+	Bitrate    int    `json:"bitrate"`
+	SampleRate int    `json:"sample_rate"`
+	Reason     string `json:"reason"`
+}
+
+// newSelectedStream describes stream selected for reason, and returns nil if no stream is selected yet
+func newSelectedStream(stream *mediaStream, reason string) *selectedStream {
+	if stream == nil {
+		return nil
+	}
+	return &selectedStream{
+		Format:     stream.Format,
+		MediaType:  stream.MediaType,
+		Resolution: stream.Resolution,
+		Codec:      stream.Codec,
+		Bitrate:    stream.Bitrate,
+		SampleRate: stream.SampleRate,
+		Reason:     reason,
+	}
+}
 
-	// respond to a request after a while for segment list file creation
-	time.Sleep(50 * time.Microsecond)
-	if _, err := io.Copy(w, strings.NewReader(fmt.Sprintf(resultFormat, pp.id, segmentListFilePath))); err != nil {
-		http.Error(w, "failed to write result into RewponseWriter "+err.Error(), http.StatusInternalServerError)
+// probeAndSaveMetadata probes HLS files of a video transcoded with a profile, and saves the result in db if a session is available.
+// Metadata is informative, so nil is returned on failure.
+func probeAndSaveMetadata(r *http.Request, videoID string, profile *transcodeProfile) []*audioMetadata {
+	metadata, err := probeStream(videoID, profile)
+	if err != nil {
+		logger.Printf("failed to probe transcoded audio of %s, %s", videoID, err)
+		return nil
+	}
+	if sess, ok := vManager.get(r, dbSessionKey).(*mgo.Session); ok {
+		if err := setAudioMetadata(sess, videoID, profile.Name, metadata); err != nil {
+			logger.Printf("failed to save metadata of %s in db, %s", videoID, err)
+		}
+	}
+	return metadata
+}
+
+// streamTracks splits a complete stream of a video transcoded with a profile into tracks by chapters in its description.
+// video is found in db, e.g. saved by the job, or fetched from YouTube if it is nil.
+// Tracks are informative, so nil is returned on failure as well as for a video without chapters.
+func streamTracks(r *http.Request, videoID string, profile *transcodeProfile, video *youtube.Video, trim *trimInfo) []*track {
+	if _, ok := jManager.source.(gotubeSource); !ok {
+		// chapters are known only for YouTube videos
+		return nil
+	}
+	if video == nil {
+		sess, _ := vManager.get(r, dbSessionKey).(*mgo.Session)
+		v, err := videoInfo(sess, videoID, profile.Name)
+		if err != nil {
+			logger.Printf("failed to get info of %s to split tracks, %s", videoID, err)
+			return nil
+		}
+		video = v
+	}
+	if len(video.Chapters) == 0 {
+		return nil
+	}
+
+	var offset float64
+	if trim != nil {
+		offset = trim.Start
+	}
+	tracks, err := writeTracks(videoID, profile, video.Chapters, offset)
+	if err != nil {
+		logger.Printf("failed to split %s into tracks, %s", videoID, err)
+		return nil
+	}
+	return tracks
+}
+
+// writeStreamResponse encodes resp into w as json with status code
+func writeStreamResponse(w http.ResponseWriter, resp *streamResponse, code int) {
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Printf("failed to write result into ResponseWriter, %s", err)
+	}
+}
+
+// ====================================================================================================
+
+// ====================================================================================================
+// Resource: downloads
+// Desc: Single audio files for offline listening
+
+// GET /downloads/:id?format=m4a
+// Responds with an audio file of the video as an attachment, whose format is m4a (default), mp3 or opus.
+// The file is tagged with title, channel as artist and date of the video as well as its thumbnail as cover art except for opus,
+// and cached as static/streams/:id/:id.:format.
+// Range requests are supported once the file is complete.
+// If the file is not ready within stream-wait, 202 Accepted is returned with json as /streams/:id,
+// {
+// 	"id": "a30jvlkjs03",
+// 	"segment_list_file_url": "/.../a30jvlkjs03/a30jvlkjs03.m4a",
+// 	"profile": "download-m4a",
+// 	"state": "transcoding",
+// 	"status_url": "/downloads/a30jvlkjs03?format=m4a",  <- request again to get the file
+// }
+// If the job has failed, the error is returned once and the next request retries.
+// While streams are encrypted, downloads are served only to listeners with a session.
+// This handler is supposed to be wraped by withVars and withDB.
+func downloadsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	pp, errParse := parsePath(r.URL.String())
+	if errParse != nil {
+		http.Error(w, fmt.Sprintf("failed to parse request path %s, %s", r.URL, errParse), http.StatusBadRequest)
+		return
+	}
+	if pp.id == "" {
+		http.Error(w, "id empty", http.StatusBadRequest)
+		return
+	}
+	formatName := defaultDownloadFormatName
+	if pp.params != nil && pp.params.Get("format") != "" {
+		formatName = pp.params.Get("format")
+	}
+	profile, errFormat := lookupDownloadFormat(formatName)
+	if errFormat != nil {
+		http.Error(w, errFormat.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the file is renamed to its final name after completion, so an existing file is complete
+	if serveDownloadFile(w, r, pp.id, profile) {
+		return
+	}
+
+	if job := jManager.get(pp.id, profile); job != nil {
+		if state, errJob := job.status(); state == jobFailed {
+			// report the failure only once, next request will retry
+			jManager.remove(job)
+			http.Error(w, fmt.Sprintf("transcode for %s failed, %s", pp.id, errJob), http.StatusInternalServerError)
+			return
+		}
+	}
+	job, _ := jManager.start(pp.id, profile, priorityPlay)
+	waitDownloadAndRespond(w, r, job)
+}
+
+// waitDownloadAndRespond waits until the download file of job is complete at most stream-wait and responds with it.
+// On timeout, 202 Accepted is returned with the request url to retry.
+// If the client goes away before the job finishes and no other request is waiting for it, the job is canceled.
+func waitDownloadAndRespond(w http.ResponseWriter, r *http.Request, job *transcodeJob) {
+	timer := time.NewTimer(*streamWaitTimeout)
+	defer timer.Stop()
+
+	job.attach()
+	abandoned := false
+	defer func() { job.detach(abandoned) }()
+
+	select {
+	case <-job.done:
+		if state, errJob := job.status(); state != jobDone {
+			jManager.remove(job)
+			http.Error(w, fmt.Sprintf("transcode for %s failed, %s", job.videoID, errJob), http.StatusInternalServerError)
+			return
+		}
+		if !serveDownloadFile(w, r, job.videoID, job.profile) {
+			http.Error(w, fmt.Sprintf("download file of %s is not found", job.videoID), http.StatusInternalServerError)
+		}
+	case <-timer.C:
+		state, _ := job.status()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(streamWaitTimeout.Seconds())))
+		writeStreamResponse(w, &streamResponse{
+			ID:                 job.videoID,
+			SegmentListFileURL: job.segmentListFilePath,
+			Profile:            job.profile.Name,
+			State:              state.String(),
+			QueuePosition:      jManager.queuePosition(job),
+			StatusURL:          r.URL.RequestURI(),
+		}, http.StatusAccepted)
+	case <-r.Context().Done():
+		// client has gone
+		abandoned = true
+	}
+}
+
+// serveDownloadFile responds with a complete download file of a video transcoded with a profile as an attachment.
+// The title saved in db is used as a file name if available.
+// It returns false without writing a response if the file does not exist.
+func serveDownloadFile(w http.ResponseWriter, r *http.Request, videoID string, profile *transcodeProfile) bool {
+	f, errOpen := os.Open(downloadFilePath(videoID, profile))
+	if errOpen != nil {
+		return false
+	}
+	defer f.Close()
+	info, errStat := f.Stat()
+	if errStat != nil {
+		return false
+	}
+
+	var title string
+	if sess, ok := vManager.get(r, dbSessionKey).(*mgo.Session); ok {
+		if video, err := getVideoInfoFromDB(sess, videoID); err == nil {
+			title = video.Title
+		}
+	}
+	cManager.touch(videoID)
+	w.Header().Set("Content-Type", name2ContentType(info.Name()))
+	w.Header().Set("Content-Disposition", contentDisposition(videoID, title, profile))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return true
+}
+
+// ====================================================================================================
+
+// ====================================================================================================
+// Resource: keys
+// Desc: Keys of encrypted HLS segments
+
+// GET /keys/:id
+// Responds with the AES-128 key of the video in binary, which a player fetches by the url in #EXT-X-KEY.
+// Keys are stored out of static directory and never cached by clients.
+// This handler is supposed to be wraped by withSession.
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	pp, errParse := parsePath(r.URL.String())
+	if errParse != nil {
+		http.Error(w, fmt.Sprintf("failed to parse request path %s, %s", r.URL, errParse), http.StatusBadRequest)
+		return
+	}
+	if pp.id == "" || strings.Contains(pp.id, "/") || strings.HasPrefix(pp.id, ".") {
+		http.Error(w, fmt.Sprintf("invalid id %s", pp.id), http.StatusBadRequest)
+		return
+	}
+
+	key, errRead := ioutil.ReadFile(keyFilePath(pp.id))
+	if errRead != nil {
+		http.Error(w, fmt.Sprintf("no key for %s", pp.id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, no-store")
+	if _, err := w.Write(key); err != nil {
+		logger.Printf("failed to write key into ResponseWriter, %s", err)
+	}
+}
+
+// ====================================================================================================
+
+// ====================================================================================================
+// Resource: cache
+// Desc: Administration of the streams cache
+
+// GET /cache
+// {
+// 	"budget": 10737418240,  <- bytes, 0 for no limit, see -cache-budget option
+// 	"pinned_size": 524288000,  <- bytes of pinned videos, which are never evicted
+// 	"pinned_videos": 12,
+// 	"evictable_size": 8589934592,
+// 	"evictable_videos": 310
+// }
+// cacheHandler reports size of static/streams.
+// This handler is supposed to be wraped by withAdmin.
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(cManager.stats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// ====================================================================================================
+
+// ====================================================================================================
+// Resource: jobs
+// Desc: Administration of transcode jobs
+
+// DELETE /jobs/:id
+// {
+// 	"id": "a30jvlkjs03",
+// 	"message": "canceled",
+// }
+// jobsHandler cancels a running transcode job of a video id.
+// Download and FFmpeg are stopped, and partially created HLS files are removed.
+// 404 is returned if no running job is found.
+// This handler is supposed to be wraped by withAdmin.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	pp, errParse := parsePath(r.URL.String())
+	if errParse != nil {
+		http.Error(w, fmt.Sprintf("failed to parse request path %s, %s", r.URL, errParse), http.StatusBadRequest)
+		return
+	}
+	if pp.id == "" {
+		http.Error(w, "id empty", http.StatusBadRequest)
+		return
+	}
+
+	if !jManager.cancel(pp.id) {
+		http.Error(w, fmt.Sprintf("no running job for %s", pp.id), http.StatusNotFound)
+		return
+	}
+	logger.Printf("job for %s is canceled by admin", pp.id)
+
+	resp := struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}{ID: pp.id, Message: "canceled"}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	w.WriteHeader(http.StatusOK) // registration on DB will be done in next call for this vide id
 }
 
 // ====================================================================================================
@@ -436,6 +1229,7 @@ func streamsHandler(w http.ResponseWriter, r *http.Request) {
 // 			{
 // 				"id": "a30jvlkjs03",
 // 				"title": "hoge",
+// 				"channel": "fuga",
 // 				"duration": "PT1H43M31S",
 // 				"view_count": "136421",
 // 				"publish_date": "2018-03-29",
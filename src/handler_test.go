@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestServedSegmentList(t *testing.T) {
+	inProgress := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXTINF:10.000000,\nsegment0000.ts\n"
+	served, complete := servedSegmentList([]byte(inProgress))
+	expected := "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXT-X-START:TIME-OFFSET=0\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:10\n#EXTINF:10.000000,\nsegment0000.ts\n"
+	if complete || string(served) != expected {
+		t.Errorf("in-progress list expected %q, got %q, complete %t", expected, served, complete)
+	}
+
+	// a higher version, e.g. of gaps in a merged list of seek streams, is kept
+	merged := "#EXTM3U\n#EXT-X-VERSION:8\n#EXT-X-TARGETDURATION:10\n#EXT-X-GAP\n#EXTINF:10.000000,\nsegment0000.ts\n"
+	served, _ = servedSegmentList([]byte(merged))
+	expected = "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXT-X-START:TIME-OFFSET=0\n#EXT-X-VERSION:8\n#EXT-X-TARGETDURATION:10\n#EXT-X-GAP\n#EXTINF:10.000000,\nsegment0000.ts\n"
+	if string(served) != expected {
+		t.Errorf("merged list expected %q, got %q", expected, served)
+	}
+
+	// type written by FFmpeg is replaced, and a start designated by a track is kept
+	track := "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXT-X-START:TIME-OFFSET=3.000,PRECISE=YES\n#EXTINF:10.000000,\nsegment0003.ts\n#EXT-X-ENDLIST\n"
+	served, complete = servedSegmentList([]byte(track))
+	expected = "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-START:TIME-OFFSET=3.000,PRECISE=YES\n#EXTINF:10.000000,\nsegment0003.ts\n#EXT-X-ENDLIST\n"
+	if !complete || string(served) != expected {
+		t.Errorf("complete list expected %q, got %q, complete %t", expected, served, complete)
+	}
+
+	master := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=140800,CODECS=\"mp4a.40.2\"\naac64/audio.m3u8\n"
+	if served, _ := servedSegmentList([]byte(master)); string(served) != master {
+		t.Errorf("master playlist should be served as it is, got %q", served)
+	}
+	if served, _ := servedSegmentList([]byte("#EXT")); string(served) != "#EXT" {
+		t.Errorf("truncated list should be served as it is, got %q", served)
+	}
+}
+
+func TestRequestedStart(t *testing.T) {
+	for query, expected := range map[string]time.Duration{
+		"":             0,
+		"start=5400":   5400 * time.Second,
+		"start=5407.5": 5400 * time.Second,
+		"start=9":      0,
+	} {
+		params, _ := url.ParseQuery(query)
+		start, err := requestedStart(&parsedPath{id: "abc", params: &params})
+		if err != nil || start != expected {
+			t.Errorf("start of %q expected %s, got %s, %v", query, expected, start, err)
+		}
+	}
+	for _, query := range []string{"start=-10", "start=abc", "start=NaN"} {
+		params, _ := url.ParseQuery(query)
+		if _, err := requestedStart(&parsedPath{id: "abc", params: &params}); err == nil {
+			t.Errorf("invalid %q should return an error", query)
+		}
+	}
+}
+
+func TestWaitJobAndRespondDone(t *testing.T) {
+	// both ready and done of a successful job are closed, and either may be selected
+	job := newTranscodeJob("abc", transcodeProfiles["aac128"], priorityPlay)
+	job.finish(nil)
+	for i := 0; i < 20; i++ {
+		rec := httptest.NewRecorder()
+		waitJobAndRespond(rec, httptest.NewRequest(http.MethodGet, "/streams/abc", nil), job)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status of a successful job expected %d, got %d, %s", http.StatusOK, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestStreamPinRequiresAdmin(t *testing.T) {
+	originalAdminToken := adminToken
+	defer func() { adminToken = originalAdminToken }()
+	adminToken = "secret"
+
+	rec := httptest.NewRecorder()
+	streamsHandler(rec, httptest.NewRequest(http.MethodOptions, "/streams/abc/pin", nil))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Headers") != adminTokenHeader {
+		t.Errorf("preflight should allow the admin token header, got %d %v", rec.Code, rec.Header())
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		rec = httptest.NewRecorder()
+		streamsHandler(rec, httptest.NewRequest(method, "/streams/abc/pin", nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s without the admin token expected 401, got %d %s", method, rec.Code, rec.Body)
+		}
+	}
+	if stats := cManager.stats(); stats.PinnedVideos != 0 {
+		t.Errorf("no video should be pinned, got %+v", stats)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// withTempStaticDir points staticDirectory to a new temporary directory, and returns it.
+// The returned function restores staticDirectory and removes the directory, which is supposed to be deferred.
+func withTempStaticDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "audiube")
+	if err != nil {
+		t.Fatal(err)
+	}
+	originalStaticDirectory := staticDirectory
+	staticDirectory = &dir
+	return dir, func() {
+		staticDirectory = originalStaticDirectory
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Timed ID3 is a data stream of ID3 tags in MPEG-TS segments, which HLS players expose as metadata of a live stream.
+// The MPEG-TS muxer of FFmpeg carries such a stream, but FFmpeg cannot make ID3 packets from -metadata,
+// so a tag is built here and written into a small MPEG-TS file, which is mapped into the output as a second input.
+const (
+	tsPacketSize = 188
+	tsPMTPID     = 0x1000
+	tsID3PID     = 0x0100
+	tsTimedID3   = 0x15 // stream type of metadata carried in PES packets
+)
+
+// id3Frames maps FFmpeg metadata to text frames of ID3v2.4 in the order written
+var id3Frames = []struct{ key, id string }{
+	{"title", "TIT2"},
+	{"artist", "TPE1"},
+	{"date", "TDRC"},
+	{"comment", "COMM"},
+}
+
+// id3Tag builds an ID3v2.4 tag from FFmpeg metadata, and returns nil if no metadata has a frame.
+// Text is encoded in UTF-8, and a comment has no description.
+func id3Tag(values map[string]string) []byte {
+	var frames []byte
+	for _, frame := range id3Frames {
+		value, ok := values[frame.key]
+		if !ok {
+			continue
+		}
+		data := []byte{0x03}
+		if frame.id == "COMM" {
+			// language and an empty description terminated by null
+			data = append(data, 'e', 'n', 'g', 0x00)
+		}
+		data = append(data, value...)
+		frames = append(frames, frame.id...)
+		frames = append(frames, syncsafe(len(data))...)
+		frames = append(frames, 0x00, 0x00)
+		frames = append(frames, data...)
+	}
+	if len(frames) == 0 {
+		return nil
+	}
+	tag := append([]byte{'I', 'D', '3', 0x04, 0x00, 0x00}, syncsafe(len(frames))...)
+	return append(tag, frames...)
+}
+
+// syncsafe encodes a size of ID3 with 7 bits in each byte
+func syncsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
+
+// timedID3TS builds MPEG-TS of a single program which carries an ID3 tag at time 0.
+// The metadata descriptor in PMT tells FFmpeg that the stream is timed ID3.
+func timedID3TS(tag []byte) ([]byte, error) {
+	// PES header, flags and PTS
+	pesLength := 3 + 5 + len(tag)
+	if pesLength > 0xffff {
+		return nil, fmt.Errorf("ID3 tag of %d bytes is too large for a PES packet", len(tag))
+	}
+	pes := []byte{0x00, 0x00, 0x01, 0xbd, byte(pesLength >> 8), byte(pesLength), 0x84, 0x80, 0x05, 0x21, 0x00, 0x01, 0x00, 0x01}
+	pes = append(pes, tag...)
+
+	pat := psiSection(0x00, 0x0001, []byte{0x00, 0x01, 0xe0 | tsPMTPID>>8, tsPMTPID & 0xff})
+	descriptor := []byte{0x26, 13, 0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x0f}
+	pmtBody := []byte{
+		0xff, 0xff, // no PCR
+		0xf0, 0x00, // no program info
+		tsTimedID3, 0xe0 | tsID3PID>>8, tsID3PID & 0xff, 0xf0, byte(len(descriptor)),
+	}
+	pmt := psiSection(0x02, 0x0001, append(pmtBody, descriptor...))
+
+	ts := tsPackets(0x0000, append([]byte{0x00}, pat...))
+	ts = append(ts, tsPackets(tsPMTPID, append([]byte{0x00}, pmt...))...)
+	return append(ts, tsPackets(tsID3PID, pes)...), nil
+}
+
+// psiSection builds a section of PSI table with its header and CRC
+func psiSection(tableID byte, tableIDExtension uint16, body []byte) []byte {
+	length := 5 + len(body) + 4
+	section := []byte{tableID, 0xb0 | byte(length>>8), byte(length), byte(tableIDExtension >> 8), byte(tableIDExtension), 0xc1, 0x00, 0x00}
+	section = append(section, body...)
+	crc := crc32MPEG2(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// crc32MPEG2 computes CRC of PSI sections, which is not reflected unlike hash/crc32
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// tsPackets splits a payload unit of a PID into MPEG-TS packets.
+// The last packet is filled by stuffing bytes of an adaptation field, so the unit ends at the end of the payload.
+func tsPackets(pid uint16, payload []byte) []byte {
+	var packets []byte
+	for counter := 0; len(payload) > 0; counter++ {
+		header := []byte{0x47, byte(pid>>8) & 0x1f, byte(pid), 0x10 | byte(counter)&0x0f}
+		if counter == 0 {
+			header[1] |= 0x40
+		}
+		packets = append(packets, header...)
+		size := tsPacketSize - len(header)
+		if len(payload) < size {
+			// adaptation field with its length, flags and stuffing
+			stuffing := size - len(payload)
+			packets[len(packets)-1] |= 0x20
+			packets = append(packets, byte(stuffing-1))
+			if stuffing > 1 {
+				packets = append(packets, 0x00)
+				for i := 2; i < stuffing; i++ {
+					packets = append(packets, 0xff)
+				}
+			}
+			size = len(payload)
+		}
+		packets = append(packets, payload[:size]...)
+		payload = payload[size:]
+	}
+	return packets
+}
+
+// saveTimedID3 writes MPEG-TS of timed ID3 made from FFmpeg metadata into a temporary file, and returns its path.
+// An empty path is returned if metadata has nothing to write.
+func saveTimedID3(videoID string, values map[string]string) (string, error) {
+	tag := id3Tag(values)
+	if tag == nil {
+		return "", nil
+	}
+	ts, errTS := timedID3TS(tag)
+	if errTS != nil {
+		return "", errTS
+	}
+
+	f, errCreate := ioutil.TempFile("", "audiube-"+videoID+"-id3-")
+	if errCreate != nil {
+		return "", errCreate
+	}
+	_, errWrite := f.Write(ts)
+	if errClose := f.Close(); errWrite == nil {
+		errWrite = errClose
+	}
+	if errWrite != nil {
+		os.Remove(f.Name())
+		return "", errWrite
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestID3Tag(t *testing.T) {
+	if tag := id3Tag(map[string]string{"album": "A"}); tag != nil {
+		t.Errorf("tag without frames should be nil, got %v", tag)
+	}
+
+	tag := id3Tag(map[string]string{"title": "Song", "comment": "url"})
+	expected := []byte("ID3\x04\x00\x00\x00\x00\x00\x21" +
+		"TIT2\x00\x00\x00\x05\x00\x00\x03Song" +
+		"COMM\x00\x00\x00\x08\x00\x00\x03eng\x00url")
+	if !bytes.Equal(tag, expected) {
+		t.Errorf("tag expected %q, got %q", expected, tag)
+	}
+
+	if size := syncsafe(300); !bytes.Equal(size, []byte{0x00, 0x00, 0x02, 0x2c}) {
+		t.Errorf("syncsafe size of 300 is unexpected %v", size)
+	}
+}
+
+func TestTimedID3TS(t *testing.T) {
+	tag := id3Tag(map[string]string{"title": string(bytes.Repeat([]byte("a"), 300))})
+	ts, err := timedID3TS(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts)%tsPacketSize != 0 {
+		t.Fatalf("MPEG-TS should consist of %d byte packets, got %d bytes", tsPacketSize, len(ts))
+	}
+
+	// payload of each PID is joined without adaptation fields
+	payloads := make(map[int][]byte)
+	for i := 0; i < len(ts); i += tsPacketSize {
+		packet := ts[i : i+tsPacketSize]
+		if packet[0] != 0x47 {
+			t.Fatalf("packet at %d has no sync byte", i)
+		}
+		pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+		payloads[pid] = append(payloads[pid], payload...)
+	}
+
+	for _, pid := range []int{0x0000, tsPMTPID} {
+		section := payloads[pid][1:]
+		length := int(section[1]&0x0f)<<8 | int(section[2])
+		if crc := crc32MPEG2(section[:3+length]); crc != 0 {
+			t.Errorf("section of PID %d has wrong CRC", pid)
+		}
+	}
+	if pmt := payloads[tsPMTPID]; pmt[13] != tsTimedID3 || !bytes.Contains(pmt, []byte("\xffID3 \xffID3 ")) {
+		t.Errorf("PMT should have a timed ID3 stream with metadata descriptor, got %v", pmt)
+	}
+	pes := payloads[tsID3PID]
+	if !bytes.HasPrefix(pes, []byte{0x00, 0x00, 0x01, 0xbd}) || !bytes.Equal(pes[14:], tag) {
+		t.Errorf("PES should carry the tag, got %v", pes)
+	}
+	if length := int(pes[4])<<8 | int(pes[5]); length != len(pes)-6 {
+		t.Errorf("PES length expected %d, got %d", len(pes)-6, length)
+	}
+}
+
+func TestSaveTimedID3(t *testing.T) {
+	if filePath, err := saveTimedID3("abc", map[string]string{}); err != nil || filePath != "" {
+		t.Errorf("nothing should be saved without tags, got %s %v", filePath, err)
+	}
+
+	filePath, err := saveTimedID3("abc", map[string]string{"title": "Song"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filePath)
+	b, errRead := ioutil.ReadFile(filePath)
+	if errRead != nil {
+		t.Fatal(errRead)
+	}
+	if len(b) == 0 || len(b)%tsPacketSize != 0 {
+		t.Errorf("saved file should be MPEG-TS, got %d bytes", len(b))
+	}
+}
+
+func TestTimedID3WithFFmpeg(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+
+	dir, errDir := ioutil.TempDir("", "audiube")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+	wavPath := path.Join(dir, "sine.wav")
+	if err := writeSineWAV(wavPath, 5); err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]string{"title": "Song", "artist": "A"}
+	timedID3Path, errID3 := saveTimedID3("sine", tags)
+	if errID3 != nil {
+		t.Fatal(errID3)
+	}
+	defer os.Remove(timedID3Path)
+
+	for name, id3Path := range map[string]string{"tagged": timedID3Path, "unrecognized": wavPath} {
+		// a data stream FFmpeg does not find in the second input is skipped
+		output := &hlsOutput{format: segmentMPEGTS, dirPath: path.Join(dir, name), tags: tags, timedID3Path: id3Path}
+		if err := os.MkdirAll(output.dirPath, 0777); err != nil {
+			t.Fatal(err)
+		}
+		args := hlsArgs("sine", transcodeProfiles["aac64"], &hlsInput{path: wavPath}, output)
+		if b, err := exec.Command("ffmpeg", args...).CombinedOutput(); err != nil {
+			t.Fatalf("transcode with %s timed ID3 failed, %s\n%s", name, err, b)
+		}
+		segment, errRead := ioutil.ReadFile(path.Join(output.dirPath, fmt.Sprintf(segmentFilename, 0)))
+		if errRead != nil {
+			t.Fatal(errRead)
+		}
+		if tagged := bytes.Contains(segment, id3Tag(tags)); tagged != (name == "tagged") {
+			t.Errorf("segment with %s timed ID3 should carry the tag %t", name, name == "tagged")
+		}
+	}
+}
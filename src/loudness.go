@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+)
+
+const (
+	// replayGainReference is loudness in LUFS which ReplayGain 2.0 adjusts audio to
+	replayGainReference = -18.0
+	// loudnormSampleRate is a sample rate which normalized audio is resampled to, since loudnorm outputs 192kHz
+	loudnormSampleRate = "48000"
+)
+
+// loudnessMode decides what the transcode pipeline does about loudness
+type loudnessMode string
+
+const (
+	loudnessOff       loudnessMode = "off"       // loudness is neither measured nor normalized
+	loudnessMeasure   loudnessMode = "measure"   // loudness of transcoded audio is measured and recorded, which clients may adjust
+	loudnessNormalize loudnessMode = "normalize" // loudness of a source is measured and transcoded audio is normalized to a target
+)
+
+// loudnormTarget is EBU R128 targets of loudness normalization
+type loudnormTarget struct {
+	IntegratedLoudness float64 // LUFS
+	TruePeak           float64 // dBTP
+	LoudnessRange      float64 // LU
+}
+
+// defaultLoudnormTarget follows loudness commonly used by streaming services
+var defaultLoudnormTarget = loudnormTarget{IntegratedLoudness: -16, TruePeak: -1.5, LoudnessRange: 11}
+
+// validateLoudness checks the mode is supported and the target is in a range loudnorm accepts
+func validateLoudness(mode loudnessMode, t *loudnormTarget) error {
+	switch mode {
+	case loudnessOff, loudnessMeasure, loudnessNormalize:
+	default:
+		return fmt.Errorf("loudness mode %s not supported, choose from %s, %s, %s", mode, loudnessOff, loudnessMeasure, loudnessNormalize)
+	}
+	if t.IntegratedLoudness < -70 || t.IntegratedLoudness > -5 {
+		return fmt.Errorf("integrated loudness target %.1f LUFS is out of range [-70, -5]", t.IntegratedLoudness)
+	}
+	return nil
+}
+
+// loudnessMeasurement is a result of the first pass of loudnorm printed in json
+type loudnessMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// loudnessInfo is loudness of a video recorded for clients.
+// ReplayGain is gain in dB which adjusts the served audio to the ReplayGain reference loudness,
+// so that clients can apply it themselves even if the server does not normalize audio.
+type loudnessInfo struct {
+	IntegratedLoudness float64 `json:"integrated_loudness"` // LUFS of the source
+	TruePeak           float64 `json:"true_peak"`           // dBTP of the source
+	LoudnessRange      float64 `json:"loudness_range"`      // LU of the source
+	Normalized         bool    `json:"normalized"`          // true if the served audio is normalized to TargetLoudness
+	TargetLoudness     float64 `json:"target_loudness,omitempty"`
+	ReplayGain         float64 `json:"replay_gain"`
+}
+
+// measureLoudness runs the first pass of loudnorm over a whole file
+func measureLoudness(ctx context.Context, filePath string, target *loudnormTarget) (*loudnessMeasurement, error) {
+	args := append([]string{"-hide_banner", "-nostats"}, hlsDemuxerOptions(filePath)...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(args,
+		"-i", filePath,
+		"-vn",
+		"-af", target.filter(nil),
+		"-f", "null", "-",
+	)...)
+	// the measurement is printed at the end of the log
+	stderr := &tailBuffer{limit: ffmpegLogTailSize}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to measure loudness of %s, %s, %s", filePath, err, stderr)
+	}
+	return parseLoudnormOutput(stderr.buf)
+}
+
+// parseLoudnormOutput extracts json printed by loudnorm at the end of FFmpeg log
+func parseLoudnormOutput(log []byte) (*loudnessMeasurement, error) {
+	start := bytes.LastIndexByte(log, '{')
+	end := bytes.LastIndexByte(log, '}')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no loudness measurement is found in FFmpeg log")
+	}
+	var m loudnessMeasurement
+	if err := json.Unmarshal(log[start:end+1], &m); err != nil {
+		return nil, fmt.Errorf("failed to parse loudness measurement, %s", err)
+	}
+	return &m, nil
+}
+
+// filter builds a loudnorm filter of FFmpeg.
+// The first pass measures loudness if m is nil, and the second pass normalizes linearly with m otherwise.
+func (t *loudnormTarget) filter(m *loudnessMeasurement) string {
+	f := fmt.Sprintf("loudnorm=I=%.1f:TP=%.1f:LRA=%.1f", t.IntegratedLoudness, t.TruePeak, t.LoudnessRange)
+	if m == nil {
+		return f + ":print_format=json"
+	}
+	return fmt.Sprintf("%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true,aresample=%s",
+		f, m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset, loudnormSampleRate)
+}
+
+// info converts the measurement into loudnessInfo.
+// An error is returned if the source is silent, whose loudness is -inf and cannot be normalized.
+func (m *loudnessMeasurement) info(target *loudnormTarget, normalized bool) (*loudnessInfo, error) {
+	values := make([]float64, 3)
+	for i, v := range []string{m.InputI, m.InputTP, m.InputLRA} {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse loudness %s, %s", v, err)
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("loudness of silent audio cannot be measured")
+		}
+		values[i] = f
+	}
+
+	info := &loudnessInfo{IntegratedLoudness: values[0], TruePeak: values[1], LoudnessRange: values[2], Normalized: normalized}
+	served := info.IntegratedLoudness
+	if normalized {
+		info.TargetLoudness = target.IntegratedLoudness
+		served = target.IntegratedLoudness
+	}
+	info.ReplayGain = math.Round((replayGainReference-served)*100) / 100
+	return info, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLoudnormOutput(t *testing.T) {
+	log := []byte(`size=N/A time=00:03:32.34 bitrate=N/A speed= 180x
+[Parsed_loudnorm_0 @ 0x55d4c1a3e2c0]
+{
+	"input_i" : "-9.84",
+	"input_tp" : "0.41",
+	"input_lra" : "6.10",
+	"input_thresh" : "-20.03",
+	"output_i" : "-16.29",
+	"output_tp" : "-1.50",
+	"output_lra" : "5.20",
+	"output_thresh" : "-26.42",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.29"
+}
+`)
+	m, err := parseLoudnormOutput(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := loudnessMeasurement{InputI: "-9.84", InputTP: "0.41", InputLRA: "6.10", InputThresh: "-20.03", TargetOffset: "0.29"}
+	if *m != expected {
+		t.Errorf("measurement expected %+v, got %+v", expected, *m)
+	}
+
+	filter := defaultLoudnormTarget.filter(m)
+	for _, option := range []string{"I=-16.0", "measured_I=-9.84", "measured_thresh=-20.03", "offset=0.29", "linear=true", "aresample=48000"} {
+		if !strings.Contains(filter, option) {
+			t.Errorf("filter should contain %s, got %s", option, filter)
+		}
+	}
+
+	if _, err := parseLoudnormOutput([]byte("Press [q] to stop")); err == nil {
+		t.Error("an error is expected for log without measurement")
+	}
+}
+
+func TestLoudnessInfo(t *testing.T) {
+	m := &loudnessMeasurement{InputI: "-9.84", InputTP: "0.41", InputLRA: "6.10", InputThresh: "-20.03", TargetOffset: "0.29"}
+
+	measured, err := m.info(&defaultLoudnormTarget, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if measured.ReplayGain != -8.16 {
+		t.Errorf("replay gain of measured audio expected -8.16, got %v", measured.ReplayGain)
+	}
+
+	normalized, err := m.info(&defaultLoudnormTarget, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if normalized.ReplayGain != -2 || normalized.TargetLoudness != -16 || normalized.IntegratedLoudness != -9.84 {
+		t.Errorf("unexpected loudness of normalized audio %+v", *normalized)
+	}
+
+	silent := &loudnessMeasurement{InputI: "-inf", InputTP: "-inf", InputLRA: "0.00", InputThresh: "-70.00", TargetOffset: "inf"}
+	if _, err := silent.info(&defaultLoudnormTarget, true); err == nil {
+		t.Error("an error is expected for silent audio")
+	}
+}
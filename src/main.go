@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
@@ -13,12 +18,66 @@ var (
 	serverPort      *int
 	logFilePath     *string
 	logger          *log.Logger
+
+	streamWaitTimeout *time.Duration
+	maxDownloads      *int
+	maxTranscodes     *int
+	shutdownTimeout   *time.Duration
+	resumeInterrupted *bool
+	defaultProfile    *string
+	mediaDirectory    *string
+
+	selectContainers *string
+	selectMedia      *string
+	selectMinBitrate *int
+	selectMaxBitrate *int
+	selectCodecs     *string
+
+	loudness       *string
+	loudnessTarget *float64
+
+	silenceTrimEnabled *bool
+	silenceThreshold   *float64
+	silenceMinDuration *time.Duration
+
+	waveformResolution *int
+	segmentFormatName  *string
+
+	encryptStreams *bool
+	keysDirectory  *string
+
+	cacheBudget *int64
+
+	allowedOrigins *string
 )
 
 func init() {
 	staticDirectory = flag.String("static", "./static", "path to a directory where static files such as index.html are")
 	serverPort = flag.Int("port", 5001, "port to listen")
 	logFilePath = flag.String("log", "", "log output file path")
+	maxDownloads = flag.Int("max-downloads", defaultMaxDownloads, "maximum number of concurrent video downloads")
+	maxTranscodes = flag.Int("max-transcodes", defaultMaxTranscodes, "maximum number of concurrent FFmpeg processes")
+	mediaDirectory = flag.String("media", "", "path to a directory of local video files named after video ids, which are used instead of YouTube if given")
+	selectContainers = flag.String("select-containers", strings.Join(defaultSelectionPolicy.Containers, ","), "preferred containers of a stream to transcode in order, separated by comma")
+	selectMedia = flag.String("select-media", string(defaultSelectionPolicy.Media), "which of audio-only and muxed streams to transcode, one of prefer-audio, audio-only, prefer-muxed")
+	selectMinBitrate = flag.Int("select-min-bitrate", 0, "minimum bitrate in kbps of a stream to transcode")
+	selectMaxBitrate = flag.Int("select-max-bitrate", 0, "maximum bitrate in kbps of a stream to transcode, 0 for no limit")
+	selectCodecs = flag.String("select-codecs", "", "preferred audio codecs of a stream to transcode in order, separated by comma, e.g. opus,mp4a, where codecs of YouTube streams are inferred from their containers")
+	loudness = flag.String("loudness", string(loudnessOff), "what to do about loudness of audio, one of off, measure (record loudness of transcoded audio), normalize (normalize audio with EBU R128 two-pass loudnorm, which waits for whole download before transcoding)")
+	loudnessTarget = flag.Float64("loudness-target", defaultLoudnormTarget.IntegratedLoudness, "target integrated loudness in LUFS of loudness normalization")
+	silenceTrimEnabled = flag.Bool("trim-silence", false, "trim leading and trailing silence of audio, which waits for whole download before transcoding")
+	silenceThreshold = flag.Float64("silence-threshold", defaultSilenceThreshold, "audio quieter than this in dB is regarded as silence to trim")
+	silenceMinDuration = flag.Duration("silence-min-duration", defaultSilenceMinDuration, "silence shorter than this is not trimmed")
+	waveformResolution = flag.Int("waveform-resolution", defaultWaveformResolution, "peaks per second of a waveform of transcoded audio served by /streams/:id/waveform")
+	segmentFormatName = flag.String("segment-format", string(segmentMPEGTS), "container of HLS segments, one of mpegts, fmp4 (CMAF fragmented MP4 with an init segment)")
+	encryptStreams = flag.Bool("encrypt", false, "encrypt HLS segments with AES-128, whose keys as well as downloads are served only to listeners with a session started with LISTENER_TOKEN")
+	keysDirectory = flag.String("keys", "./keys", "path to a directory where keys of encrypted streams are stored, which must not be under static")
+	allowedOrigins = flag.String("allowed-origins", "", "origins of players on other sites allowed to use sessions, keys and downloads with cookies, e.g. https://player.example.com, separated by comma")
+	cacheBudget = flag.Int64("cache-budget", 0, "maximum size in MB of static/streams, least recently played videos are evicted beyond it, 0 for no limit")
+	defaultProfile = flag.String("profile", defaultProfileName, "default transcode profile, one of "+strings.Join(profileNames(), ", "))
+	streamWaitTimeout = flag.Duration("stream-wait", 10*time.Second, "how long /streams/:id waits for a segment list file before answering that transcoding is in progress")
+	resumeInterrupted = flag.Bool("resume-interrupted", false, "restart transcodes interrupted in a previous run on startup, otherwise their files are just removed")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests and transcodes on shutdown before aborting them")
 }
 
 // YouTube audio player service.
@@ -27,6 +86,8 @@ func init() {
 //   * conversion from video to audio
 //   * successive distribution
 func main() {
+	flag.Parse()
+
 	if *logFilePath == "" {
 		logger = log.New(os.Stdout, "http: ", log.LstdFlags)
 	} else {
@@ -38,10 +99,78 @@ func main() {
 		logger = log.New(f, "http: ", log.LstdFlags)
 	}
 
+	if _, err := lookupProfile(*defaultProfile); err != nil {
+		logger.Fatal(err)
+	}
+	jManager.policy = selectionPolicy{
+		Containers: splitList(*selectContainers),
+		Media:      mediaPreference(*selectMedia),
+		MinBitrate: *selectMinBitrate,
+		MaxBitrate: *selectMaxBitrate,
+		Codecs:     splitList(*selectCodecs),
+	}
+	if err := jManager.policy.validate(); err != nil {
+		logger.Fatal(err)
+	}
+	jManager.loudness = loudnessMode(*loudness)
+	jManager.loudnormTarget.IntegratedLoudness = *loudnessTarget
+	if err := validateLoudness(jManager.loudness, &jManager.loudnormTarget); err != nil {
+		logger.Fatal(err)
+	}
+	if *silenceTrimEnabled {
+		jManager.silenceTrim = &silenceTrimConfig{Threshold: *silenceThreshold, MinDuration: *silenceMinDuration}
+		if err := jManager.silenceTrim.validate(); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if *waveformResolution < 1 || *waveformResolution > waveformSampleRate {
+		logger.Fatalf("waveform resolution %d is out of range [1, %d]", *waveformResolution, waveformSampleRate)
+	}
+	jManager.waveform = *waveformResolution
+	jManager.segmentFormat = segmentFormat(*segmentFormatName)
+	if err := validateSegmentFormat(jManager.segmentFormat); err != nil {
+		logger.Fatal(err)
+	}
+	if *encryptStreams && listenerToken == "" {
+		logger.Fatal("encryption requires LISTENER_TOKEN to serve keys")
+	}
+	jManager.encrypt = *encryptStreams
+	for _, origin := range splitList(*allowedOrigins) {
+		credentialedOrigins[origin] = true
+	}
+	if *mediaDirectory != "" {
+		jManager.source = fileSource{dir: *mediaDirectory}
+	}
+	// no job would ever get a worker of a pool without one
+	if *maxDownloads < 1 {
+		logger.Fatalf("max downloads %d must be at least 1", *maxDownloads)
+	}
+	if *maxTranscodes < 1 {
+		logger.Fatalf("max transcodes %d must be at least 1", *maxTranscodes)
+	}
+	jManager.downloads.setLimit(*maxDownloads)
+	jManager.transcodes.setLimit(*maxTranscodes)
+	// jobs resumed by reconcileStreams report their streams to cManager, so the budget is set before them
+	cManager.budget = *cacheBudget << 20
+	reconcileStreams(*resumeInterrupted)
+	cManager.scan()
+	cManager.restorePins()
+	cManager.enforce()
+
 	http.HandleFunc("/", handleWithLogging(indexHandler))
 	http.HandleFunc("/static/", handleWithLogging(allowCORS(staticFileHandler)))
 	http.HandleFunc("/videos/", handleWithLogging(allowCORS(setContentTypeJSON(videosHandler))))
 	http.HandleFunc("/streams/", handleWithLogging(allowCORS(setContentTypeJSON(withVars(withDB(streamsHandler))))))
+	downloads := allowCORS(withVars(withDB(downloadsHandler)))
+	if jManager.encrypt {
+		// download files are not encrypted
+		downloads = allowCredentialedCORS(withSession(withVars(withDB(downloadsHandler))))
+	}
+	http.HandleFunc("/downloads/", handleWithLogging(downloads))
+	http.HandleFunc("/keys/", handleWithLogging(allowCredentialedCORS(withSession(keysHandler))))
+	http.HandleFunc("/sessions", handleWithLogging(allowCredentialedCORS(setContentTypeJSON(sessionsHandler))))
+	http.HandleFunc("/cache", handleWithLogging(withAdmin(setContentTypeJSON(cacheHandler))))
+	http.HandleFunc("/jobs/", handleWithLogging(withAdmin(setContentTypeJSON(jobsHandler))))
 
 	s := &http.Server{
 		Addr:     fmt.Sprintf(":%d", *serverPort),
@@ -49,7 +178,35 @@ func main() {
 		ErrorLog: logger,
 	}
 	logger.Printf("audiube server start listening on port %d", *serverPort)
-	if err := s.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	go func() {
+		if err := s.ListenAndServe(); err != http.ErrServerClosed {
+			logger.Fatal(err)
+		}
+	}()
+
+	// graceful shutdown on SIGTERM or SIGINT
+	//   1. stop accepting requests and wait for in-flight responses
+	//   2. wait for running transcodes, and abort those which do not finish in time
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	logger.Printf("received %s, shutting down", <-sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Printf("failed to shutdown server gracefully, %s", err)
+	}
+	jManager.shutdown(ctx)
+	logger.Print("audiube server stopped")
+}
+
+// splitList splits a comma separated flag value, ignoring empty items
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
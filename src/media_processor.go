@@ -1,160 +1,1503 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"math"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/matthewlujp/gotube"
+	mgo "gopkg.in/mgo.v2"
 )
 
-// fetchVideoAndBuildHLS is responsible for three tasks
+var (
+	errJobCanceled  = errors.New("transcode job canceled")
+	errShuttingDown = errors.New("server is shutting down")
+)
+
+const (
+	ffmpegLogTailSize          = 2048                   // bytes of FFmpeg stderr kept to report a reason of failure
+	segmentListPollingInterval = 200 * time.Millisecond // interval to check whether FFmpeg has written a segment list file
+	defaultMaxDownloads        = 4                      // default limit of concurrent downloads
+	defaultMaxTranscodes       = 2                      // default limit of concurrent FFmpeg processes
+	durationTolerance          = 2 * time.Second        // difference of durations between a source and its transcoded audio regarded as normal
+)
+
+// jobState represents a stage of a transcode job
+type jobState int
+
+const (
+	jobQueued jobState = iota
+	jobDownloading
+	jobTranscoding
+	jobDone
+	jobFailed
+)
+
+func (s jobState) String() string {
+	switch s {
+	case jobQueued:
+		return "queued"
+	case jobDownloading:
+		return "downloading"
+	case jobTranscoding:
+		return "transcoding"
+	case jobDone:
+		return "done"
+	case jobFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// transcodeJob holds progress of download and transcode for a single video with a profile.
+// A job is shared among all requests for the same video id and profile.
+type transcodeJob struct {
+	videoID             string
+	profile             *transcodeProfile
+	segmentListFilePath string
+	ready               chan struct{} // closed when the segment list file with at least one segment is written
+	done                chan struct{} // closed when the job finishes regardless of its result
+	ctx                 context.Context
+	cancelFunc          context.CancelFunc
+
+	readyOnce sync.Once
+	lock      sync.RWMutex
+	state     jobState
+	err       error
+	listeners int // number of requests waiting for the job to get ready
+	priority  jobPriority
+	stream    *mediaStream     // stream selected to transcode
+	reason    string           // why stream is selected
+	metadata  []*audioMetadata // properties of transcoded audio, set after the job is done
+	loudness  *loudnessInfo    // measured loudness, set only if loudness is measured
+	trim      *trimInfo        // how silence is trimmed, set only if silence is trimmed
+	start     time.Duration    // position in the source where transcoding starts, 0 for the whole stream
+}
+
+func newTranscodeJob(videoID string, profile *transcodeProfile, priority jobPriority) *transcodeJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &transcodeJob{
+		videoID:             videoID,
+		profile:             profile,
+		segmentListFilePath: outputFilePath(videoID, profile),
+		ready:               make(chan struct{}),
+		done:                make(chan struct{}),
+		ctx:                 ctx,
+		cancelFunc:          cancel,
+		state:               jobQueued,
+		priority:            priority,
+	}
+}
+
+// newSeekJob creates a job transcoding a video from start into a seek stream,
+// which lets a listener play from start before the whole stream is transcoded until there.
+// Its segment list file url is of the whole stream, which is served with segments of the seek stream.
+func newSeekJob(videoID string, profile *transcodeProfile, priority jobPriority, start time.Duration) *transcodeJob {
+	j := newTranscodeJob(videoID, profile, priority)
+	j.start = start
+	return j
+}
+
+// dirPath returns a directory where the job writes HLS files
+func (j *transcodeJob) dirPath() string {
+	if j.start > 0 {
+		return seekDirPath(j.videoID, j.profile.Name, j.start)
+	}
+	return hlsProfileDirPath(j.videoID, j.profile.Name)
+}
+
+// renditionSegmentListFilePaths returns paths of segment list files the job writes segments into
+func (j *transcodeJob) renditionSegmentListFilePaths() []string {
+	return renditionSegmentListFilePathsIn(j.dirPath(), j.profile)
+}
+
+// status returns current state of the job and an error if the job has failed
+func (j *transcodeJob) status() (jobState, error) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.state, j.err
+}
+
+func (j *transcodeJob) setState(s jobState) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.state = s
+}
+
+// setSelection records a stream selected to transcode and a reason of the selection
+func (j *transcodeJob) setSelection(stream *mediaStream, reason string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.stream = stream
+	j.reason = reason
+}
+
+// selection returns a stream selected to transcode and a reason of the selection.
+// stream is nil until the job selects one.
+func (j *transcodeJob) selection() (*mediaStream, string) {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.stream, j.reason
+}
+
+// setMetadata records properties of transcoded audio
+func (j *transcodeJob) setMetadata(metadata []*audioMetadata) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.metadata = metadata
+}
+
+// getMetadata returns properties of transcoded audio, which is nil until the job is done
+func (j *transcodeJob) getMetadata() []*audioMetadata {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.metadata
+}
+
+func (j *transcodeJob) setLoudness(loudness *loudnessInfo) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.loudness = loudness
+}
+
+// getLoudness returns measured loudness, which is nil until it is measured
+func (j *transcodeJob) getLoudness() *loudnessInfo {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.loudness
+}
+
+func (j *transcodeJob) setTrim(trim *trimInfo) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.trim = trim
+}
+
+// getTrim returns how silence is trimmed, which is nil unless silence is trimmed
+func (j *transcodeJob) getTrim() *trimInfo {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.trim
+}
+
+// key identifies the job in jobManager
+func (j *transcodeJob) key() string {
+	return seekJobKey(j.videoID, j.profile.Name, j.start)
+}
+
+func (j *transcodeJob) getPriority() jobPriority {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.priority
+}
+
+// cancel stops download and FFmpeg of the job.
+// The job finishes as failed with errJobCanceled unless it has already finished.
+func (j *transcodeJob) cancel() {
+	j.cancelFunc()
+}
+
+// attach registers a request waiting for the job to get ready
+func (j *transcodeJob) attach() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.listeners++
+}
+
+// detach deregisters a waiting request.
+// If abandoned is true, i.e. the client has gone, and no other request is waiting for the job which has not got ready yet,
+// the job is canceled since nobody is going to listen to it.
+func (j *transcodeJob) detach(abandoned bool) {
+	j.lock.Lock()
+	j.listeners--
+	remaining := j.listeners
+	j.lock.Unlock()
+
+	if !abandoned || remaining > 0 {
+		return
+	}
+	select {
+	case <-j.ready:
+		// someone may be playing already
+	default:
+		logger.Printf("all listeners of %s have gone, cancel the job", j.videoID)
+		j.cancel()
+	}
+}
+
+// markReady notifies waiters that the segment list file is playable
+func (j *transcodeJob) markReady() {
+	j.readyOnce.Do(func() { close(j.ready) })
+}
+
+// finish records a result of the job and notifies waiters
+func (j *transcodeJob) finish(err error) {
+	j.lock.Lock()
+	if err != nil {
+		j.state = jobFailed
+		j.err = err
+	} else {
+		j.state = jobDone
+	}
+	j.lock.Unlock()
+	if err == nil {
+		j.markReady()
+	}
+	close(j.done)
+}
+
+// jobManager keeps track of transcode jobs keyed by video id and profile,
+// so that concurrent requests for the same video share a single download and FFmpeg process.
+// The number of concurrent downloads and FFmpeg processes is limited by worker pools.
+// Videos are fetched from source, loudness of transcoded audio is handled according to loudness,
+// and leading and trailing silence is trimmed if silenceTrim is set.
+type jobManager struct {
+	lock           sync.Mutex
+	jobs           map[string]*transcodeJob
+	source         MediaSource
+	policy         selectionPolicy
+	loudness       loudnessMode
+	loudnormTarget loudnormTarget     // used for both measurement and normalization
+	silenceTrim    *silenceTrimConfig // nil not to trim silence
+	waveform       int                // peaks per second of a waveform generated after transcoding
+	segmentFormat  segmentFormat
+	encrypt        bool // segments are encrypted with AES-128 and their key is served only to listeners
+	downloads      *workerPool
+	transcodes     *workerPool
+	closed         bool // true after shutdown is called, no job is started anymore
+
+	// waveforms are generated on request for streams built before, keyed like jobs
+	waveforms map[string]*waveformJob
+}
+
+// jManager is a singleton instance of jobManager
+var jManager = jobManager{
+	jobs:           make(map[string]*transcodeJob),
+	source:         gotubeSource{},
+	policy:         defaultSelectionPolicy,
+	loudness:       loudnessOff,
+	loudnormTarget: defaultLoudnormTarget,
+	waveform:       defaultWaveformResolution,
+	waveforms:      make(map[string]*waveformJob),
+	segmentFormat:  segmentMPEGTS,
+	downloads:      newWorkerPool(defaultMaxDownloads),
+	transcodes:     newWorkerPool(defaultMaxTranscodes),
+}
+
+// start returns a job for videoID and profile.
+// If such a job is already running, the caller attaches to it and the second return value is false.
+// In that case, the job is promoted if priority is higher than its current one.
+// Otherwise, a new job is started in a goroutine and the second return value is true.
+// A failed job is replaced with a new one, i.e. calling start retries.
+func (jm *jobManager) start(videoID string, profile *transcodeProfile, priority jobPriority) (*transcodeJob, bool) {
+	return jm.startAt(videoID, profile, priority, 0)
+}
+
+// startAt is the same as start except that a job starting at a positive start transcodes a seek stream,
+// which is a job distinct from one for the whole stream.
+func (jm *jobManager) startAt(videoID string, profile *transcodeProfile, priority jobPriority, start time.Duration) (*transcodeJob, bool) {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+
+	if j, ok := jm.jobs[seekJobKey(videoID, profile.Name, start)]; ok {
+		if s, _ := j.status(); s != jobFailed {
+			jm.promote(j, priority)
+			return j, false
+		}
+	}
+
+	j := newTranscodeJob(videoID, profile, priority)
+	if start > 0 {
+		j = newSeekJob(videoID, profile, priority, start)
+	}
+	jm.jobs[j.key()] = j
+	if jm.closed {
+		j.cancelFunc()
+		j.finish(errShuttingDown)
+		return j, true
+	}
+	go func() {
+		defer j.cancelFunc() // release resources of the context
+		err := fetchVideAndBuildHLS(j)
+		if err != nil {
+			logger.Printf("transcode job for %s with %s failed, %s", videoID, profile.Name, err)
+		}
+		j.finish(err)
+
+		// successful job is no longer necessary since its result is on the disk
+		if err == nil {
+			jm.remove(j)
+			saveMetadata(j)
+		}
+		// files are added, or removed on failure
+		cManager.update(videoID)
+		if err == nil {
+			cManager.enforce()
+		}
+	}()
+	return j, true
+}
+
+// promote raises priority of j, which takes effect in the queues of worker pools
+func (jm *jobManager) promote(j *transcodeJob, priority jobPriority) {
+	j.lock.Lock()
+	if j.priority >= priority {
+		j.lock.Unlock()
+		return
+	}
+	j.priority = priority
+	j.lock.Unlock()
+
+	jm.downloads.promote(j, priority)
+	jm.transcodes.promote(j, priority)
+}
+
+// queuePosition returns 1-based position of j in a queue of worker pools, or 0 if j is not waiting
+func (jm *jobManager) queuePosition(j *transcodeJob) int {
+	if pos := jm.downloads.position(j); pos > 0 {
+		return pos
+	}
+	return jm.transcodes.position(j)
+}
+
+// shutdown stops accepting new jobs and waits for running jobs to finish until ctx is done.
+// Jobs still waiting for workers are canceled immediately,
+// and jobs not finished before ctx is done are canceled, which removes their partial HLS files.
+// shutdown returns after all the jobs have finished either way.
+func (jm *jobManager) shutdown(ctx context.Context) {
+	jm.lock.Lock()
+	jm.closed = true
+	jobs := make([]*transcodeJob, 0, len(jm.jobs))
+	for _, j := range jm.jobs {
+		jobs = append(jobs, j)
+	}
+	jm.lock.Unlock()
+
+	for _, j := range jobs {
+		if s, _ := j.status(); s == jobQueued {
+			j.cancel()
+		}
+	}
+	for _, j := range jobs {
+		select {
+		case <-j.done:
+		case <-ctx.Done():
+			logger.Printf("abort transcode job for %s on shutdown", j.videoID)
+			j.cancel()
+			<-j.done
+		}
+	}
+}
+
+// get returns a job for videoID and profile, or nil if no job is registered
+func (jm *jobManager) get(videoID string, profile *transcodeProfile) *transcodeJob {
+	return jm.getAt(videoID, profile, 0)
+}
+
+// getAt returns a job for videoID and profile starting at start, or nil if no job is registered
+func (jm *jobManager) getAt(videoID string, profile *transcodeProfile, start time.Duration) *transcodeJob {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	return jm.jobs[seekJobKey(videoID, profile.Name, start)]
+}
+
+// cancel stops running jobs for videoID regardless of their profiles.
+// It returns false if no running job is found.
+func (jm *jobManager) cancel(videoID string) bool {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+
+	canceled := false
+	for _, j := range jm.jobs {
+		if j.videoID != videoID {
+			continue
+		}
+		select {
+		case <-j.done:
+		default:
+			j.cancel()
+			canceled = true
+		}
+	}
+	return canceled
+}
+
+// running reports whether a job for videoID is running regardless of its profile
+func (jm *jobManager) running(videoID string) bool {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	for _, j := range jm.jobs {
+		if j.videoID != videoID {
+			continue
+		}
+		select {
+		case <-j.done:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// remove deletes j from the manager only if j is still the registered job for its video id and profile
+func (jm *jobManager) remove(j *transcodeJob) {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	if registered, ok := jm.jobs[j.key()]; ok && registered == j {
+		delete(jm.jobs, j.key())
+	}
+}
+
+// jobKey builds a key of jobManager.jobs
+func jobKey(videoID, profileName string) string {
+	return videoID + "/" + profileName
+}
+
+// seekJobKey builds a key of a job starting at start, which is the same as jobKey for the whole stream
+func seekJobKey(videoID, profileName string, start time.Duration) string {
+	if start > 0 {
+		return fmt.Sprintf("%s@%d", jobKey(videoID, profileName), start/time.Second)
+	}
+	return jobKey(videoID, profileName)
+}
+
+// fetchVideoAndBuildHLS is responsible for two tasks
 //   1.download: use chunk fetch (goroutine)
-//   2.FFmpeg: successively start transcoding from fetch data (goroutine)
-//   3.respond: receive message from a goroutine where transcoding runs, respond to request and register segment list file url to db
-// Returns,
-//   * segment list file path
-//   * error
-func fetchVideAndBuildHLS(videoID string) (string, error) {
-	// TODO: remove failed HLS file
+//   2.FFmpeg: successively start transcoding from fetch data
+// Progress is recorded in job, and this function returns when FFmpeg has exited.
+// If transcoding fails, the directory for HLS files of the video and profile is removed so that a partial segment list file is never served.
+func fetchVideAndBuildHLS(job *transcodeJob) error {
+	err := buildHLS(job)
+	if err != nil {
+		if job.profile.isFile() {
+			os.Remove(partialDownloadFilePath(job.videoID, job.profile))
+		}
+		if job.start > 0 {
+			// the whole stream may be in progress in the profile directory
+			if errRemove := os.RemoveAll(job.dirPath()); errRemove != nil {
+				logger.Printf("failed to remove seek stream of %s, %s", job.videoID, errRemove)
+			}
+			return err
+		}
+		// remove failed HLS files
+		if errRemove := removeProfileDir(job.videoID, job.profile.Name); errRemove != nil {
+			logger.Printf("failed to remove HLS directory of %s, %s", job.videoID, errRemove)
+		}
+	}
+	return err
+}
+
+// saveMetadata saves properties, loudness, and trimming of audio transcoded by a successful job in db,
+// as well as the stream selected to transcode, which are reported after the job is removed.
+// Metadata is informative, so failure is only logged.
+func saveMetadata(job *transcodeJob) {
+	metadata, loudness, trim, stream := job.getMetadata(), job.getLoudness(), job.getTrim(), newSelectedStream(job.selection())
+	if job.profile.isFile() || metadata == nil && loudness == nil && trim == nil && stream == nil {
+		// db keeps only HLS streams
+		return
+	}
+	sess, errDial := mgo.Dial(mongoURL)
+	if errDial != nil {
+		logger.Printf("failed to connect to db to save metadata of %s, %s", job.videoID, errDial)
+		return
+	}
+	defer sess.Close()
+	if metadata != nil {
+		if err := setAudioMetadata(sess, job.videoID, job.profile.Name, metadata); err != nil {
+			logger.Printf("failed to save metadata of %s in db, %s", job.videoID, err)
+		}
+	}
+	if loudness != nil {
+		if err := setLoudness(sess, job.videoID, job.profile.Name, loudness); err != nil {
+			logger.Printf("failed to save loudness of %s in db, %s", job.videoID, err)
+		}
+	}
+	if trim != nil {
+		if err := setTrim(sess, job.videoID, job.profile.Name, trim); err != nil {
+			logger.Printf("failed to save trimming of %s in db, %s", job.videoID, err)
+		}
+	}
+	if stream != nil {
+		if err := setSelectedStream(sess, job.videoID, job.profile.Name, stream); err != nil {
+			logger.Printf("failed to save selected stream of %s in db, %s", job.videoID, err)
+		}
+	}
+}
+
+// jobWorkers are workers of download and FFmpeg held by a job, each of which is released as soon as the job is done with it.
+// Workers are acquired in order of priority, and a download worker is always acquired first to avoid deadlock.
+type jobWorkers struct {
+	job         *transcodeJob
+	lock        sync.Mutex // download is released by the goroutine feeding FFmpeg
+	downloading bool
+	transcoding bool
+}
+
+// acquireDownload waits for a download worker, and returns errJobCanceled if the job is canceled meanwhile
+func (w *jobWorkers) acquireDownload() error {
+	if err := jManager.downloads.acquire(w.job.ctx, w.job); err != nil {
+		return errJobCanceled
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.downloading = true
+	return nil
+}
+
+// acquireTranscode waits for a FFmpeg worker, and returns errJobCanceled if the job is canceled meanwhile
+func (w *jobWorkers) acquireTranscode() error {
+	if err := jManager.transcodes.acquire(w.job.ctx, w.job); err != nil {
+		return errJobCanceled
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.transcoding = true
+	return nil
+}
+
+// releaseDownload returns the download worker once the whole source has been read, and does nothing if it is not held
+func (w *jobWorkers) releaseDownload() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.downloading {
+		w.downloading = false
+		jManager.downloads.release()
+	}
+}
+
+// release returns all workers still held
+func (w *jobWorkers) release() {
+	w.releaseDownload()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.transcoding {
+		w.transcoding = false
+		jManager.transcodes.release()
+	}
+}
+
+// buildHLS downloads a video and runs FFmpeg until it exits
+func buildHLS(job *transcodeJob) error {
+	// a download worker is necessary to fetch the source, and FFmpeg waits for its worker in openInput
+	workers := &jobWorkers{job: job}
+	defer workers.release()
+	if err := workers.acquireDownload(); err != nil {
+		return err
+	}
+
 	// download video
-	stream, errSelect := selectStream(videoID)
+	job.setState(jobDownloading)
+	streams, errList := jManager.source.ListStreams(job.videoID)
+	if errList != nil {
+		return errList
+	}
+	stream, reason, errSelect := selectStream(streams, &jManager.policy)
 	if errSelect != nil {
-		return "", errSelect
+		return errSelect
+	}
+	logger.Printf("selected %s %s stream %s of %s, %s", stream.Format, stream.MediaType, stream.Resolution, job.videoID, reason)
+	job.setSelection(stream, reason)
+	expectedDuration, errDuration := jManager.source.Duration(stream)
+	if errDuration != nil {
+		return errDuration
+	}
+	if job.ctx.Err() != nil {
+		return errJobCanceled
+	}
+	input, r, errInput := openInput(job, stream, workers)
+	if errInput != nil {
+		return errInput
 	}
-	dataChan, errDL := stream.SequentialChunkDownload(10 * time.Second) // conducted in a goroutine
-	if errDL != nil {
-		return "", errDL
+	if r != nil {
+		defer r.Close()
+	}
+	if input.temporary {
+		defer os.Remove(input.path)
 	}
 
-	// create diretory to save transcoded audio files
-	if _, err := os.Stat(hlsSaveDirPath(videoID)); os.IsNotExist(err) {
-		if errCreate := os.MkdirAll(hlsSaveDirPath(videoID), 0777); errCreate != nil {
-			return "", fmt.Errorf("failed to create directory to save transcoded audio file, %s", errCreate)
+	// create diretories to save transcoded audio files
+	dirPaths := []string{hlsSaveDirPath(job.videoID)}
+	if !job.profile.isFile() {
+		dirPaths = dirPaths[:0]
+		for _, segmentListFilePath := range job.renditionSegmentListFilePaths() {
+			dirPaths = append(dirPaths, path.Dir(segmentListFilePath))
+		}
+	}
+	for _, dirPath := range dirPaths {
+		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+			if errCreate := os.MkdirAll(dirPath, 0777); errCreate != nil {
+				return fmt.Errorf("failed to create directory to save transcoded audio file, %s", errCreate)
+			}
 		}
 	}
 
 	// prepare for FFmpeg transcode
-	segmentListFilePath := path.Join(hlsSaveDirPath(videoID), segmentListFilename)
-	cmd := exec.Command(
-		"ffmpeg",
-		"-y",
-		"-i", "pipe:0",
-		"-codec:", "copy",
-		"-vn",
+	// FFmpeg is killed when the job is canceled
+	output := &hlsOutput{format: jManager.segmentFormat, dirPath: job.dirPath()}
+	if jManager.encrypt && !job.profile.isFile() {
+		keyInfoFilePath, errKey := prepareKey(job.videoID)
+		if errKey != nil {
+			return fmt.Errorf("failed to prepare key of %s, %s", job.videoID, errKey)
+		}
+		output.keyInfoFilePath = keyInfoFilePath
+	}
+	var args []string
+	if job.profile.isFile() {
+		args = fileArgs(job.videoID, job.profile, input, jobTags(job))
+	} else {
+		output.tags = jobTags(job).values
+		if output.format == segmentMPEGTS && !job.profile.isAdaptive() {
+			// tags are informative, so the stream is built without timed ID3 on failure
+			timedID3Path, errID3 := saveTimedID3(job.videoID, output.tags)
+			if errID3 != nil {
+				logger.Printf("failed to save timed ID3 of %s, %s", job.videoID, errID3)
+			} else if timedID3Path != "" {
+				defer os.Remove(timedID3Path)
+				output.timedID3Path = timedID3Path
+			}
+		}
+		args = hlsArgs(job.videoID, job.profile, input, output)
+	}
+	cmd := exec.CommandContext(job.ctx, "ffmpeg", args...)
+	// keep the last part of FFmpeg log to report a reason of failure
+	stderr := &tailBuffer{limit: ffmpegLogTailSize}
+	cmd.Stderr = stderr
+	// get input pipeline for FFmpeg unless the source has been saved in a file
+	var w io.WriteCloser
+	if input.path == stdinInput {
+		var errStdin error
+		if w, errStdin = cmd.StdinPipe(); errStdin != nil {
+			return fmt.Errorf("failed to get stdin for FFmpeg command execution, %s", errStdin)
+		}
+	}
+
+	job.setState(jobTranscoding)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start FFmpeg, %s", err)
+	}
+
+	// send received data to input pipe of FFmpeg
+	// copy ends when download completes, the job is canceled, or FFmpeg stops reading
+	fed := make(chan struct{})
+	if w == nil {
+		close(fed)
+	} else {
+		go func() {
+			defer close(fed)
+			defer w.Close()
+			_, err := io.Copy(w, r)
+			// FFmpeg may keep encoding buffered input, while another job can download
+			workers.releaseDownload()
+			if err != nil && job.ctx.Err() == nil {
+				// FFmpeg exit status is reported by Wait
+				logger.Printf("failed to send data of %s into FFmpeg, %s", job.videoID, err)
+			}
+		}()
+	}
+
+	// notify waiters as soon as the first segment becomes available
+	// a single file is ready only when it is complete
+	exited := make(chan struct{})
+	defer close(exited)
+	if !job.profile.isFile() {
+		go func() {
+			if waitForSegmentLists(job.renditionSegmentListFilePaths(), exited) {
+				job.markReady()
+			}
+		}()
+	}
+
+	// all writes to stdin must complete before calling Wait
+	<-fed
+	errWait := cmd.Wait()
+	if job.ctx.Err() != nil {
+		// FFmpeg may have finished successfully with partial input
+		return errJobCanceled
+	}
+	if errWait != nil {
+		return fmt.Errorf("FFmpeg for %s exited with %s, %s", job.videoID, errWait, stderr)
+	}
+	if job.profile.isFile() {
+		// the file is published after it is complete
+		if err := os.Rename(partialDownloadFilePath(job.videoID, job.profile), downloadFilePath(job.videoID, job.profile)); err != nil {
+			return fmt.Errorf("failed to save downloaded file of %s, %s", job.videoID, err)
+		}
+		return nil
+	}
+	if job.start > 0 {
+		// a seek stream is superseded by the whole stream, which is analyzed instead
+		return nil
+	}
+
+	// duration reported by the source may be wrong, so the real one is probed from the result
+	metadata, errProbe := probeStream(job.videoID, job.profile)
+	if errProbe != nil {
+		logger.Printf("failed to probe transcoded audio of %s, %s", job.videoID, errProbe)
+		return nil
+	}
+	if trim := job.getTrim(); trim != nil {
+		expectedDuration = time.Duration(trim.TrimmedDuration * float64(time.Second))
+	}
+	if d := metadata[0].duration() - expectedDuration; d > durationTolerance || d < -durationTolerance {
+		logger.Printf("duration of %s is %s while its source reported %s", job.videoID, metadata[0].duration(), expectedDuration)
+	}
+	job.setMetadata(metadata)
+
+	if jManager.loudness == loudnessMeasure {
+		// measured on the result, so that playback does not wait for the whole download
+		if err := measureTranscodedLoudness(job); err != nil {
+			logger.Printf("failed to measure loudness of %s, %s", job.videoID, err)
+		}
+	}
+	if err := writeWaveform(job.ctx, job.videoID, job.profile, jManager.waveform); err != nil {
+		logger.Printf("failed to generate waveform of %s, %s", job.videoID, err)
+	}
+	return nil
+}
+
+// openInput opens a stream selected by a job and decides how FFmpeg reads it.
+// A seek job lets FFmpeg open a stream of a seekableSource by itself, in which case the returned reader is nil.
+// Otherwise the stream is fetched from the beginning, and the caller is responsible for closing the reader.
+// A seek job skips silence trimming and loudness normalization, which need a whole source, so start is a position in the source.
+// A FFmpeg worker is acquired in workers by the time input is returned, and the download worker is released unless the source is piped.
+func openInput(job *transcodeJob, stream *mediaStream, workers *jobWorkers) (*hlsInput, io.ReadCloser, error) {
+	if job.start > 0 {
+		s, ok := jManager.source.(seekableSource)
+		if !ok {
+			return nil, nil, fmt.Errorf("source of %s cannot seek", job.videoID)
+		}
+		p, err := s.StreamPath(stream)
+		if err != nil {
+			return nil, nil, err
+		}
+		// FFmpeg reads the source by itself
+		workers.releaseDownload()
+		if err := workers.acquireTranscode(); err != nil {
+			return nil, nil, err
+		}
+		return &hlsInput{path: p, start: job.start}, nil, nil
+	}
+
+	if !savesSource() {
+		// download and FFmpeg run simultaneously through a pipe, so both workers are necessary before starting
+		if err := workers.acquireTranscode(); err != nil {
+			return nil, nil, err
+		}
+	}
+	r, errOpen := jManager.source.OpenStream(job.ctx, stream) // reading stops when the job is canceled
+	if errOpen != nil {
+		return nil, nil, errOpen
+	}
+	input, errInput := prepareInput(job, r, workers)
+	if errInput != nil {
+		r.Close()
+		if job.ctx.Err() != nil {
+			return nil, nil, errJobCanceled
+		}
+		return nil, nil, errInput
+	}
+	return input, r, nil
+}
+
+// prepareInput decides how FFmpeg reads a source from r.
+// Silence trimming and loudness normalization need a whole source before transcoding,
+// so the source is saved in a temporary file and analyzed in that case, otherwise it is piped into FFmpeg.
+// The caller is responsible for removing the file unless input is stdin.
+// A saved source is analyzed and transcoded after the download worker is exchanged for a FFmpeg worker.
+func prepareInput(job *transcodeJob, r io.Reader, workers *jobWorkers) (*hlsInput, error) {
+	input := &hlsInput{path: stdinInput}
+	if !savesSource() {
+		return input, nil
+	}
+
+	sourceFilePath, errSave := saveSource(job, r)
+	if errSave != nil {
+		return nil, errSave
+	}
+	workers.releaseDownload()
+	if err := workers.acquireTranscode(); err != nil {
+		os.Remove(sourceFilePath)
+		return nil, err
+	}
+	input.path = sourceFilePath
+	input.temporary = true
+	job.setState(jobTranscoding)
+
+	// silence is trimmed before normalization, which does not matter to loudness since silence is gated out of measurement
+	if jManager.silenceTrim != nil {
+		source, errProbe := probeAudio(sourceFilePath)
+		if errProbe != nil {
+			os.Remove(sourceFilePath)
+			return nil, errProbe
+		}
+		intervals, errDetect := detectSilence(job.ctx, sourceFilePath, jManager.silenceTrim)
+		if errDetect != nil {
+			os.Remove(sourceFilePath)
+			return nil, errDetect
+		}
+		trim := trimSilence(intervals, source.Duration)
+		if filter := trim.filter(); filter != "" {
+			logger.Printf("trim silence of %s, keep %.1fs-%.1fs of %.1fs", job.videoID, trim.Start, trim.End, trim.OriginalDuration)
+			input.filters = append(input.filters, filter)
+		}
+		job.setTrim(trim)
+	}
+
+	if jManager.loudness == loudnessNormalize {
+		m, errMeasure := measureLoudness(job.ctx, sourceFilePath, &jManager.loudnormTarget)
+		if errMeasure != nil {
+			os.Remove(sourceFilePath)
+			return nil, errMeasure
+		}
+		if loudness, err := m.info(&jManager.loudnormTarget, true); err != nil {
+			// e.g. silent audio, which is transcoded as it is
+			logger.Printf("skip loudness normalization of %s, %s", job.videoID, err)
+		} else {
+			input.filters = append(input.filters, jManager.loudnormTarget.filter(m))
+			job.setLoudness(loudness)
+		}
+	}
+	return input, nil
+}
+
+// savesSource tells whether a source is saved before transcoding, which is necessary to analyze the whole source
+func savesSource() bool {
+	return jManager.silenceTrim != nil || jManager.loudness == loudnessNormalize
+}
+
+// saveSource downloads a whole source of a job into a temporary file and returns its path.
+// The caller is responsible for removing the file.
+func saveSource(job *transcodeJob, r io.Reader) (string, error) {
+	f, errCreate := ioutil.TempFile("", "audiube-"+job.videoID+"-")
+	if errCreate != nil {
+		return "", fmt.Errorf("failed to create a temporary file to save source of %s, %s", job.videoID, errCreate)
+	}
+	_, errCopy := io.Copy(f, r)
+	errClose := f.Close()
+	if errCopy != nil || errClose != nil {
+		os.Remove(f.Name())
+		if job.ctx.Err() != nil {
+			return "", errJobCanceled
+		}
+		if errCopy == nil {
+			errCopy = errClose
+		}
+		return "", fmt.Errorf("failed to save source of %s, %s", job.videoID, errCopy)
+	}
+	return f.Name(), nil
+}
+
+// measureTranscodedLoudness measures loudness of audio transcoded by a job and records it in the job.
+// For an adaptive profile, the first rendition is measured since renditions differ only in bitrate.
+func measureTranscodedLoudness(job *transcodeJob) error {
+	segmentListFilePath, cleanup, errLocal := localSegmentList(renditionSegmentListFilePaths(job.videoID, job.profile)[0])
+	if errLocal != nil {
+		return errLocal
+	}
+	defer cleanup()
+	m, err := measureLoudness(job.ctx, segmentListFilePath, &jManager.loudnormTarget)
+	if err != nil {
+		return err
+	}
+	loudness, errInfo := m.info(&jManager.loudnormTarget, false)
+	if errInfo != nil {
+		return errInfo
+	}
+	job.setLoudness(loudness)
+	return nil
+}
+
+// stdinInput is an FFmpeg input reading stdin
+const stdinInput = "pipe:0"
+
+// hlsInput describes an input of FFmpeg building HLS files or a single file, and how it is processed before encoding
+type hlsInput struct {
+	path      string        // file path, or stdinInput to read a source through a pipe
+	temporary bool          // path is a temporary file removed after transcoding
+	filters   []string      // FFmpeg audio filters applied in order
+	start     time.Duration // position in the source where transcoding starts
+}
+
+// segmentFormat is a container of HLS segments
+type segmentFormat string
+
+const (
+	segmentMPEGTS segmentFormat = "mpegts" // MPEG-TS segments supported by any HLS player
+	segmentFMP4   segmentFormat = "fmp4"   // CMAF fragmented MP4 segments following an init segment, preferred by modern players
+)
+
+// validateSegmentFormat checks the format is supported
+func validateSegmentFormat(format segmentFormat) error {
+	switch format {
+	case segmentMPEGTS, segmentFMP4:
+		return nil
+	}
+	return fmt.Errorf("segment format %s not supported, choose from %s, %s", format, segmentMPEGTS, segmentFMP4)
+}
+
+// hlsOutput describes how FFmpeg writes HLS files
+type hlsOutput struct {
+	format          segmentFormat
+	keyInfoFilePath string            // key info file of FFmpeg to encrypt segments, empty not to encrypt
+	dirPath         string            // directory to write HLS files into, empty for the directory of the profile
+	tags            map[string]string // FFmpeg metadata written into segments
+	timedID3Path    string            // MPEG-TS file of timed ID3 added as a data stream, empty if none
+}
+
+// hlsArgs builds FFmpeg options to transcode audio from input into HLS files of a profile as output describes.
+// An adaptive profile encodes each rendition from the same input and creates a master playlist.
+// Output is not cut by duration reported by a source, which may be wrong, but lasts until the end of input.
+// A segment list file refers to its own segments and key, so streams built with other options remain playable.
+// Input starting at a position is seeked before decoding, and timestamps of output start at 0.
+// Its segments are numbered from the slot of the position in the whole stream, which is also their media sequence and IV of encryption.
+// Timed ID3 is mapped only into MPEG-TS of a single rendition, since var_stream_map of FFmpeg maps only audio, video and subtitles,
+// and fMP4 segments cannot carry it. Tags of the other streams are kept by -metadata only.
+func hlsArgs(videoID string, profile *transcodeProfile, input *hlsInput, output *hlsOutput) []string {
+	dirPath := output.dirPath
+	if dirPath == "" {
+		dirPath = hlsProfileDirPath(videoID, profile.Name)
+	}
+	args := []string{"-y"}
+	if input.start > 0 {
+		args = append(args, "-ss", strconv.FormatInt(int64(input.start/time.Second), 10))
+	}
+	args = append(args, "-i", input.path)
+	timedID3 := output.timedID3Path != "" && output.format == segmentMPEGTS && !profile.isAdaptive()
+	if timedID3 {
+		args = append(args, "-i", output.timedID3Path)
+	}
+	args = append(args, "-vn")
+	if len(input.filters) > 0 {
+		// applied to every rendition
+		args = append(args, "-af", strings.Join(input.filters, ","))
+	}
+
+	// audio is re-encoded according to the profile
+	if profile.isAdaptive() {
+		// "%v" in output paths is replaced with a rendition name by FFmpeg
+		varStreamMap := make([]string, 0, len(profile.Renditions))
+		for i := range profile.Renditions {
+			args = append(args, "-map", "0:a:0")
+			varStreamMap = append(varStreamMap, fmt.Sprintf("a:%d,name:%s", i, profile.Renditions[i].Name))
+		}
+		for i, rendition := range profile.Renditions {
+			args = append(args, rendition.args(fmt.Sprintf(":%d", i))...)
+		}
+		args = append(args,
+			"-var_stream_map", strings.Join(varStreamMap, " "),
+			"-master_pl_name", masterListFilename,
+		)
+		dirPath = path.Join(dirPath, "%v")
+	} else {
+		if timedID3 {
+			// the data stream is copied as it is, and FFmpeg cannot encode data.
+			// It is optional, so audio is transcoded without timed ID3 if FFmpeg does not recognize the stream.
+			args = append(args, "-map", "0:a:0", "-map", "1:d:0?", "-c:d", "copy")
+		}
+		args = append(args, profile.args("")...)
+	}
+	args = append(args, metadataArgs(output.tags)...)
+
+	filename := segmentFilename
+	if output.format == segmentFMP4 {
+		// an init segment is written next to the segment list file of each rendition
+		initFilename := fmp4InitFilename
+		if profile.isAdaptive() {
+			// FFmpeg requires a distinct name for each rendition
+			initFilename = "init_%v.mp4"
+		}
+		args = append(args, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", initFilename)
+		filename = fmp4SegmentFilename
+	}
+	if output.keyInfoFilePath != "" {
+		// FFmpeg writes #EXT-X-KEY with the key url, and IV is the media sequence number of each segment
+		args = append(args, "-hls_key_info_file", output.keyInfoFilePath)
+	}
+
+	return append(args,
 		"-ss", "0",
-		"-t", format(stream.Duration),
-		"-start_number", "0",
+		"-start_number", strconv.Itoa(int(input.start/seekStep)),
 		"-hls_time", "10",
 		"-hls_list_size", "0",
+		"-hls_segment_filename", path.Join(dirPath, filename),
 		"-f", "hls",
-		segmentListFilePath,
+		path.Join(dirPath, segmentListFilename),
 	)
-	// get input pipeline for FFmpeg
-	w, errStdin := cmd.StdinPipe()
-	if errStdin != nil {
-		return "", fmt.Errorf("failed to get stdin for FFmpeg command execution, %s", errStdin)
+}
+
+// metadataArgs builds FFmpeg options of global metadata sorted by keys
+func metadataArgs(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
 	}
-	// send received data to input pipe of FFmpeg
-	go func() {
-		defer w.Close()
-		for data := range dataChan {
-			w.Write(data)
+	sort.Strings(keys)
+	args := make([]string, 0, 2*len(keys))
+	for _, key := range keys {
+		args = append(args, "-metadata", key+"="+values[key])
+	}
+	return args
+}
+
+// fileArgs builds FFmpeg options to transcode audio from input into a single file of a profile with tags and cover art.
+// The file is written with a temporary name, which is renamed after completion.
+func fileArgs(videoID string, profile *transcodeProfile, input *hlsInput, tags *audioTags) []string {
+	args := []string{
+		"-y",
+		"-i", input.path,
+	}
+	if tags.coverPath != "" {
+		// video of the source is dropped, and the image is attached instead
+		args = append(args,
+			"-i", tags.coverPath,
+			"-map", "0:a:0",
+			"-map", "1:v:0",
+			"-c:v", "copy",
+			"-disposition:v:0", "attached_pic",
+		)
+		if profile.Muxer == "mp3" {
+			// APIC frame of ID3 is typed as a front cover by its comment
+			args = append(args, "-metadata:s:v", "title=Album cover", "-metadata:s:v", "comment=Cover (front)")
 		}
-	}()
-	cmd.Start() // start transcoding by FFmpeg in background
-	return segmentListFilePath, nil
+	} else {
+		args = append(args, "-vn")
+	}
+	if len(input.filters) > 0 {
+		args = append(args, "-af", strings.Join(input.filters, ","))
+	}
+	args = append(args, profile.args("")...)
+
+	args = append(args, metadataArgs(tags.values)...)
+	switch profile.Muxer {
+	case "ipod":
+		// players can start before downloading the whole file
+		args = append(args, "-movflags", "+faststart")
+	case "mp3":
+		// ID3v2.4 is not supported by some players
+		args = append(args, "-id3v2_version", "3")
+	}
+	return append(args, "-f", profile.Muxer, partialDownloadFilePath(videoID, profile))
 }
 
-// selectStream selects propper stream for videoID.
-func selectStream(videoID string) (*gotube.Stream, error) {
-	// prepare downloader and collect necessary info
-	downloader, errBuild := gotube.NewDownloader(
-		fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID),
-	)
-	if errBuild != nil {
-		return nil, errBuild
+// waitForSegmentLists polls segment list files until each of them lists at least one segment.
+// It returns true if segments are found and false if stop is closed before that.
+func waitForSegmentLists(segmentListFilePaths []string, stop <-chan struct{}) bool {
+	ticker := time.NewTicker(segmentListPollingInterval)
+	defer ticker.Stop()
+	for {
+		found := true
+		for _, segmentListFilePath := range segmentListFilePaths {
+			found = found && hasSegment(segmentListFilePath)
+		}
+		if found {
+			return true
+		}
+		select {
+		case <-stop:
+			return false
+		case <-ticker.C:
+		}
 	}
-	if err := downloader.FetchStreams(); err != nil {
-		return nil, err
+}
+
+// isCompleteStream reports whether HLS files of a video transcoded with a profile have been written until the end.
+// For an adaptive profile, the master playlist and all the renditions must be complete.
+func isCompleteStream(videoID, profileName string) bool {
+	profile, errProfile := lookupProfile(profileName)
+	if errProfile != nil {
+		return false
 	}
+	return isCompleteHLS(hlsProfileDirPath(videoID, profileName), profile)
+}
 
-	// seek appropriate streams
-	// policy:
-	//   1. seek mp4 && audio
-	//   2. seek mp4 && smallest resolution
-	candidateStream := downloader.Streams[0]
-	for _, stream := range downloader.Streams {
-		// if current candidate is not mp4, force to exchange
-		if candidateStream.Format != "mp4" {
-			candidateStream = stream
+// isCompleteSeekStream is the same as isCompleteStream for a seek stream starting at start
+func isCompleteSeekStream(videoID string, profile *transcodeProfile, start time.Duration) bool {
+	return isCompleteHLS(seekDirPath(videoID, profile.Name, start), profile)
+}
+
+// isCompleteHLS reports whether HLS files of a profile in dirPath have been written until the end
+func isCompleteHLS(dirPath string, profile *transcodeProfile) bool {
+	if _, err := os.Stat(segmentListFilePathIn(dirPath, profile)); err != nil {
+		return false
+	}
+	for _, segmentListFilePath := range renditionSegmentListFilePathsIn(dirPath, profile) {
+		if !isCompleteSegmentList(segmentListFilePath) {
+			return false
 		}
+	}
+	return true
+}
+
+// isCompleteSegmentList reports whether a segment list file exists and has been written until the end.
+// FFmpeg appends #EXT-X-ENDLIST when it finishes, so a file without it is left by an interrupted transcode.
+func isCompleteSegmentList(segmentListFilePath string) bool {
+	b, err := ioutil.ReadFile(segmentListFilePath)
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(b, []byte("#EXT-X-ENDLIST"))
+}
 
-		if stream.Format != "mp4" {
+// hasSegment reports whether a segment list file exists and lists at least one segment.
+// FFmpeg writes a segment list file after the corresponding segment is completed.
+func hasSegment(segmentListFilePath string) bool {
+	b, err := ioutil.ReadFile(segmentListFilePath)
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(b, []byte("#EXTINF"))
+}
+
+// listedDuration sums up durations of segments listed in a segment list file, which is 0 if the file does not exist
+func listedDuration(segmentListFilePath string) time.Duration {
+	b, err := ioutil.ReadFile(segmentListFilePath)
+	if err != nil {
+		return 0
+	}
+	var seconds float64
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "#EXTINF:") {
 			continue
 		}
+		// #EXTINF:10.005333,
+		value := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0]
+		if d, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			seconds += d
+		}
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
 
-		if stream.MediaType == "audio" {
-			// break if stream is mp4 and audio
-			candidateStream = stream
-			break
+// tailBuffer is an io.Writer which keeps only last limit bytes written
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.limit {
+		b.buf = b.buf[len(b.buf)-b.limit:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return strings.TrimSpace(string(b.buf))
+}
+
+// mediaPreference decides which of audio-only and muxed, i.e. video with audio, streams is selected
+type mediaPreference string
+
+const (
+	preferAudio mediaPreference = "prefer-audio" // audio-only stream if any, otherwise muxed stream
+	audioOnly   mediaPreference = "audio-only"   // only audio-only streams
+	preferMuxed mediaPreference = "prefer-muxed" // muxed stream if any, otherwise audio-only stream
+)
+
+// selectionPolicy declares how selectStream chooses a stream among streams of a video
+type selectionPolicy struct {
+	Containers []string // preferred containers in order, others are selected only if none of them is available
+	Media      mediaPreference
+	MinBitrate int      // kbps, streams of unknown bitrate are not filtered
+	MaxBitrate int      // kbps, 0 for no limit, streams of unknown bitrate are not filtered
+	Codecs     []string // preferred codecs in order, matched by prefix, e.g. "mp4a" matches "mp4a.40.2"
+}
+
+// defaultSelectionPolicy prefers mp4 audio of the best quality, and mp4 video of the smallest size next
+var defaultSelectionPolicy = selectionPolicy{Containers: []string{"mp4"}, Media: preferAudio}
+
+// validate checks the policy is consistent
+func (p *selectionPolicy) validate() error {
+	switch p.Media {
+	case preferAudio, audioOnly, preferMuxed:
+	default:
+		return fmt.Errorf("media preference %s not supported, choose from %s, %s, %s", p.Media, preferAudio, audioOnly, preferMuxed)
+	}
+	if p.MaxBitrate > 0 && p.MinBitrate > p.MaxBitrate {
+		return fmt.Errorf("min bitrate %dkbps exceeds max bitrate %dkbps", p.MinBitrate, p.MaxBitrate)
+	}
+	return nil
+}
+
+// accepts reports whether stream passes filters of the policy
+func (p *selectionPolicy) accepts(stream *mediaStream) bool {
+	if p.Media == audioOnly && stream.MediaType != "audio" {
+		return false
+	}
+	if stream.Bitrate > 0 {
+		if stream.Bitrate < p.MinBitrate || (p.MaxBitrate > 0 && stream.Bitrate > p.MaxBitrate) {
+			return false
+		}
+	}
+	return true
+}
+
+// containerRank returns 0-based rank of a stream container in preference, or len(p.Containers) if not preferred
+func (p *selectionPolicy) containerRank(stream *mediaStream) int {
+	for i, c := range p.Containers {
+		if stream.Format == c {
+			return i
 		}
+	}
+	return len(p.Containers)
+}
+
+// codecRank returns 0-based rank of a stream codec in preference, or len(p.Codecs) if not preferred or unknown
+func (p *selectionPolicy) codecRank(stream *mediaStream) int {
+	for i, c := range p.Codecs {
+		if stream.Codec != "" && strings.HasPrefix(stream.Codec, c) {
+			return i
+		}
+	}
+	return len(p.Codecs)
+}
+
+// mediaRank returns 0 if media type of stream is preferred, otherwise 1
+func (p *selectionPolicy) mediaRank(stream *mediaStream) int {
+	isAudio := stream.MediaType == "audio"
+	if isAudio == (p.Media != preferMuxed) {
+		return 0
+	}
+	return 1
+}
+
+// prefers reports whether stream1 is preferred to stream2 under the policy.
+// Streams are compared by container, media type, and codec in this order,
+// and then by streamScore if they are equal in all of them.
+func (p *selectionPolicy) prefers(stream1, stream2 *mediaStream) bool {
+	if r1, r2 := p.containerRank(stream1), p.containerRank(stream2); r1 != r2 {
+		return r1 < r2
+	}
+	if r1, r2 := p.mediaRank(stream1), p.mediaRank(stream2); r1 != r2 {
+		return r1 < r2
+	}
+	if r1, r2 := p.codecRank(stream1), p.codecRank(stream2); r1 != r2 {
+		return r1 < r2
+	}
+	return streamScore(stream1) > streamScore(stream2)
+}
 
-		if r, err := compareStreamResolution(stream, candidateStream); err == nil && r < 0 {
-			// change to smaller stream only if compare succeeds
+// selectStream selects propper stream among streams of a video according to policy.
+// It also returns a reason of the selection, which is useful to debug why a video sounds bad.
+func selectStream(streams []*mediaStream, policy *selectionPolicy) (*mediaStream, string, error) {
+	if len(streams) == 0 {
+		return nil, "", errors.New("no stream is available")
+	}
+
+	var candidateStream *mediaStream
+	accepted := 0
+	for _, stream := range streams {
+		if !policy.accepts(stream) {
+			continue
+		}
+		accepted++
+		if candidateStream == nil || policy.prefers(stream, candidateStream) {
 			candidateStream = stream
 		}
 	}
+	if candidateStream == nil {
+		return nil, "", fmt.Errorf("none of %d streams satisfies selection policy %+v", len(streams), *policy)
+	}
 
-	return candidateStream, nil
+	reasons := make([]string, 0, 4)
+	if r := policy.containerRank(candidateStream); r < len(policy.Containers) {
+		reasons = append(reasons, fmt.Sprintf("container %s is preference #%d", candidateStream.Format, r+1))
+	} else {
+		reasons = append(reasons, fmt.Sprintf("no preferred container %v is available, fell back to %s", policy.Containers, candidateStream.Format))
+	}
+	reasons = append(reasons, fmt.Sprintf("%s stream under %s", candidateStream.MediaType, policy.Media))
+	if r := policy.codecRank(candidateStream); r < len(policy.Codecs) {
+		reasons = append(reasons, fmt.Sprintf("codec %s is preference #%d", candidateStream.Codec, r+1))
+	}
+	reasons = append(reasons, fmt.Sprintf("%d of %d streams passed filters", accepted, len(streams)))
+	return candidateStream, strings.Join(reasons, ", "), nil
 }
 
-// "480p" -> 480
-func resolution2Numeric(res string) (int, error) {
-	return strconv.Atoi(strings.TrimSuffix(res, "p"))
+// streamQuality is quality of a stream parsed from its resolution label.
+// Fields which the label does not mention are left zero.
+type streamQuality struct {
+	Height     int  // e.g. 1080 for "1080p60"
+	FrameRate  int  // e.g. 60 for "1080p60"
+	HDR        bool // true for "720p HDR"
+	Bitrate    int  // kbps, e.g. 128 for "128kbps"
+	SampleRate int  // Hz, e.g. 44100 for "44.1kHz"
 }
 
-// compareStreamResolution returns one of  -1, 0, or 1
-//   -1 if stream1.Resolution < stream2.Resolution
-//   0 if stream1.Resolution == stream2.Resolution
-//   1 if stream1.Resolution > stream2.Resolution
-func compareStreamResolution(stream1, stream2 *gotube.Stream) (int, error) {
-	r1, err1 := resolution2Numeric(stream1.Resolution)
-	if err1 != nil {
-		return 0, err1
+// parseStreamQuality parses a resolution label of a stream.
+// A label consists of space separated tokens such as "1080p60", "720p HDR", "128kbps" or "48kHz",
+// and it is empty for most of audio-only streams. Unknown tokens are ignored.
+func parseStreamQuality(label string) streamQuality {
+	var q streamQuality
+	for _, token := range strings.Fields(strings.ToLower(label)) {
+		switch {
+		case token == "hdr":
+			q.HDR = true
+		case strings.HasSuffix(token, "kbps"):
+			q.Bitrate, _ = strconv.Atoi(strings.TrimSuffix(token, "kbps"))
+		case strings.HasSuffix(token, "khz"):
+			if f, err := strconv.ParseFloat(strings.TrimSuffix(token, "khz"), 64); err == nil {
+				q.SampleRate = int(f * 1000)
+			}
+		case strings.HasSuffix(token, "hz"):
+			q.SampleRate, _ = strconv.Atoi(strings.TrimSuffix(token, "hz"))
+		case strings.Contains(token, "p"):
+			// "1080p" or "1080p60"
+			i := strings.Index(token, "p")
+			height, err := strconv.Atoi(token[:i])
+			if err != nil {
+				continue
+			}
+			q.Height = height
+			if token[i+1:] != "" {
+				q.FrameRate, _ = strconv.Atoi(token[i+1:])
+			}
+		}
 	}
-	r2, err2 := resolution2Numeric(stream2.Resolution)
-	if err2 != nil {
-		return 0, err2
+	return q
+}
+
+const (
+	// videoBaseScore is a score of a video stream of unknown quality.
+	// Scores of video streams decrease from it as they get larger.
+	videoBaseScore = 1 << 30
+	// defaultFrameRate is assumed for a video label without frame rate, e.g. "480p"
+	defaultFrameRate = 30
+)
+
+// streamScore rates a stream as a source of audio, a larger score is better.
+//
+// Audio-only streams are scored by bitrate, and then by sample rate,
+// since they decide quality of transcoded audio. Unknown bitrate or sample rate counts as zero.
+//
+// Video streams are scored by size, since audio of muxed streams hardly differs while
+// a smaller one is downloaded faster. Lower resolution, lower frame rate, and SDR are preferred in this order.
+// A video of unknown resolution is scored below any video of known resolution.
+//
+// Scores of audio-only and video streams are not comparable and must not be compared with each other.
+func streamScore(stream *mediaStream) int {
+	q := parseStreamQuality(stream.Resolution)
+	if stream.MediaType == "audio" {
+		bitrate, sampleRate := stream.Bitrate, stream.SampleRate
+		if bitrate == 0 {
+			bitrate = q.Bitrate
+		}
+		if sampleRate == 0 {
+			sampleRate = q.SampleRate
+		}
+		return bitrate*1000000 + sampleRate // sample rates are below 1MHz
 	}
 
-	var cmpRes int
-	switch {
-	case r1 < r2:
-		cmpRes = -1
-	case r1 == r2:
-		cmpRes = 0
-	case r1 > r2:
-		cmpRes = 1
+	if q.Height == 0 {
+		return 0
+	}
+	frameRate := q.FrameRate
+	if frameRate == 0 {
+		frameRate = defaultFrameRate
 	}
-	return cmpRes, nil
+	size := q.Height*1000 + frameRate*2 // frame rates are below 500
+	if q.HDR {
+		size++
+	}
+	return videoBaseScore - size
 }
 
 // hlsSaveDirPath defines where to save HLS file
 func hlsSaveDirPath(videoID string) string {
-	return path.Join(*staticDirectory, "streams", videoID) // static/streams/videoID
+	return path.Join(streamsDirPath(), videoID) // static/streams/videoID
+}
+
+// hlsProfileDirPath defines where to save HLS file of a video transcoded with a profile
+func hlsProfileDirPath(videoID, profileName string) string {
+	return path.Join(hlsSaveDirPath(videoID), profileName) // static/streams/videoID/profile
+}
+
+// hlsSegmentListFilePath returns a path of a segment list file of a video transcoded with a profile,
+// which is a master playlist for an adaptive profile
+func hlsSegmentListFilePath(videoID, profileName string) string {
+	if p, ok := transcodeProfiles[profileName]; ok && p.isAdaptive() {
+		return path.Join(hlsProfileDirPath(videoID, profileName), masterListFilename) // static/streams/videoID/profile/master.m3u8
+	}
+	return path.Join(hlsProfileDirPath(videoID, profileName), segmentListFilename) // static/streams/videoID/profile/audio.m3u8
+}
+
+// seekDirPath defines where to save HLS files of a video transcoded with a profile from start.
+// Seek streams are out of the profile directory, which is removed if the whole stream fails.
+func seekDirPath(videoID, profileName string, start time.Duration) string {
+	return path.Join(hlsSaveDirPath(videoID), seekDirName, profileName, strconv.FormatInt(int64(start/time.Second), 10)) // static/streams/videoID/seek/profile/5400
+}
+
+// segmentListFilePathIn returns a path of a segment list file, or a master playlist for an adaptive profile, in dirPath
+func segmentListFilePathIn(dirPath string, profile *transcodeProfile) string {
+	if profile.isAdaptive() {
+		return path.Join(dirPath, masterListFilename)
+	}
+	return path.Join(dirPath, segmentListFilename)
+}
+
+// outputFilePath returns a path of a file which a job transcoding a video with a profile produces
+func outputFilePath(videoID string, profile *transcodeProfile) string {
+	if profile.isFile() {
+		return downloadFilePath(videoID, profile)
+	}
+	return hlsSegmentListFilePath(videoID, profile.Name)
+}
+
+// downloadFilePath returns a path of a single file of a video transcoded with a profile for download
+func downloadFilePath(videoID string, profile *transcodeProfile) string {
+	return path.Join(hlsSaveDirPath(videoID), videoID+"."+profile.Extension) // static/streams/videoID/videoID.m4a
+}
+
+// partialDownloadFilePath returns a temporary path of a single file being transcoded
+func partialDownloadFilePath(videoID string, profile *transcodeProfile) string {
+	return downloadFilePath(videoID, profile) + partialFileSuffix // static/streams/videoID/videoID.m4a.part
+}
+
+// partialFileSuffix is appended to a file being written, which is removed if transcoding is interrupted
+const partialFileSuffix = ".part"
+
+// renditionSegmentListFilePaths returns paths of segment list files which actually list segments.
+// For an adaptive profile, they are segment list files of renditions, otherwise, the segment list file of the profile itself.
+func renditionSegmentListFilePaths(videoID string, profile *transcodeProfile) []string {
+	return renditionSegmentListFilePathsIn(hlsProfileDirPath(videoID, profile.Name), profile)
+}
+
+// renditionSegmentListFilePathsIn is the same as renditionSegmentListFilePaths for HLS files in dirPath
+func renditionSegmentListFilePathsIn(dirPath string, profile *transcodeProfile) []string {
+	if !profile.isAdaptive() {
+		return []string{path.Join(dirPath, segmentListFilename)}
+	}
+	paths := make([]string, 0, len(profile.Renditions))
+	for _, rendition := range profile.Renditions {
+		paths = append(paths, path.Join(dirPath, rendition.Name, segmentListFilename)) // static/streams/videoID/profile/rendition/audio.m3u8
+	}
+	return paths
+}
+
+// removeProfileDir removes HLS files of a video transcoded with a profile.
+// The directory of the video is also removed if no other profile remains.
+func removeProfileDir(videoID, profileName string) error {
+	if err := os.RemoveAll(hlsProfileDirPath(videoID, profileName)); err != nil {
+		return err
+	}
+	if entries, err := ioutil.ReadDir(hlsSaveDirPath(videoID)); err == nil && len(entries) == 0 {
+		return os.Remove(hlsSaveDirPath(videoID))
+	}
+	return nil
 }
 
-// format build string form duration for ffmpeg option -t.
-// time.Duration to "01:23:11"
-func format(d time.Duration) string {
-	h := int(math.Floor(d.Hours()))
-	m := int(math.Floor(d.Minutes())) % 60
-	s := int(math.Floor(d.Seconds())) % 60
-	return fmt.Sprintf("%02d:%02d:%02d", h, m, s)
+// streamsDirPath is a directory where HLS files of all videos are saved
+func streamsDirPath() string {
+	return path.Join(*staticDirectory, "streams") // static/streams
 }
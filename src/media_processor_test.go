@@ -0,0 +1,362 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger = log.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+func TestTailBuffer(t *testing.T) {
+	b := &tailBuffer{limit: 8}
+	for _, s := range []string{"abc", "defgh", "ijkl"} {
+		if n, err := b.Write([]byte(s)); err != nil || n != len(s) {
+			t.Errorf("write %s expected (%d, nil), got (%d, %v)", s, len(s), n, err)
+		}
+	}
+	if b.String() != "efghijkl" {
+		t.Errorf("tail expected %s, got %s", "efghijkl", b.String())
+	}
+}
+
+func TestHasSegment(t *testing.T) {
+	dir, errDir := ioutil.TempDir("", "audiube")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+	segmentListFilePath := path.Join(dir, segmentListFilename)
+
+	if hasSegment(segmentListFilePath) {
+		t.Error("segment list file does not exist but hasSegment returned true")
+	}
+
+	if err := ioutil.WriteFile(segmentListFilePath, []byte("#EXTM3U\n#EXT-X-VERSION:3\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if hasSegment(segmentListFilePath) {
+		t.Error("segment list file has no segment but hasSegment returned true")
+	}
+
+	if err := ioutil.WriteFile(segmentListFilePath, []byte("#EXTM3U\n#EXT-X-VERSION:3\n#EXTINF:10.005333,\nsegment0000.ts\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if !hasSegment(segmentListFilePath) {
+		t.Error("segment list file has a segment but hasSegment returned false")
+	}
+}
+
+func TestHLSArgsAdaptive(t *testing.T) {
+	dir := "static"
+	originalStaticDirectory := staticDirectory
+	defer func() { staticDirectory = originalStaticDirectory }()
+	staticDirectory = &dir
+
+	args := strings.Join(hlsArgs("abc", transcodeProfiles["abr"], &hlsInput{path: "/tmp/source", filters: []string{"volume=0.5", "aresample=48000"}}, &hlsOutput{format: segmentMPEGTS}), " ")
+	for _, expected := range []string{
+		"-i /tmp/source -vn -af volume=0.5,aresample=48000",
+		"-map 0:a:0 -map 0:a:0 -map 0:a:0",
+		"-c:a:0 aac -b:a:0 64k -c:a:1 aac -b:a:1 128k -c:a:2 aac -b:a:2 256k",
+		"-var_stream_map a:0,name:aac64 a:1,name:aac128 a:2,name:aac256",
+		"-master_pl_name master.m3u8",
+		"-hls_segment_filename static/streams/abc/abr/%v/segment%04d.ts",
+		"-f hls static/streams/abc/abr/%v/audio.m3u8",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("args should contain %s, got %s", expected, args)
+		}
+	}
+}
+
+func TestHLSArgsOutput(t *testing.T) {
+	dir := "static"
+	originalStaticDirectory := staticDirectory
+	defer func() { staticDirectory = originalStaticDirectory }()
+	staticDirectory = &dir
+
+	for profileName, expected := range map[string]string{
+		"aac128": "-hls_segment_type fmp4 -hls_fmp4_init_filename init.mp4 -ss 0 -start_number 0 -hls_time 10 -hls_list_size 0 -hls_segment_filename static/streams/abc/aac128/segment%04d.m4s",
+		"abr":    "-hls_segment_type fmp4 -hls_fmp4_init_filename init_%v.mp4 -ss 0 -start_number 0 -hls_time 10 -hls_list_size 0 -hls_segment_filename static/streams/abc/abr/%v/segment%04d.m4s",
+	} {
+		args := strings.Join(hlsArgs("abc", transcodeProfiles[profileName], &hlsInput{path: stdinInput}, &hlsOutput{format: segmentFMP4}), " ")
+		if !strings.Contains(args, expected) {
+			t.Errorf("args with %s should contain %s, got %s", profileName, expected, args)
+		}
+	}
+
+	args := strings.Join(hlsArgs("abc", transcodeProfiles["aac128"], &hlsInput{path: stdinInput}, &hlsOutput{format: segmentMPEGTS, keyInfoFilePath: "keys/abc.keyinfo"}), " ")
+	if !strings.Contains(args, "-hls_key_info_file keys/abc.keyinfo") {
+		t.Errorf("args for encryption should contain key info file, got %s", args)
+	}
+
+	if err := validateSegmentFormat("webm"); err == nil {
+		t.Error("unsupported segment format webm should return an error")
+	}
+}
+
+func TestHLSArgsTags(t *testing.T) {
+	dir := "static"
+	originalStaticDirectory := staticDirectory
+	defer func() { staticDirectory = originalStaticDirectory }()
+	staticDirectory = &dir
+
+	output := &hlsOutput{format: segmentMPEGTS, tags: map[string]string{"title": "Song", "artist": "A"}, timedID3Path: "/tmp/id3"}
+	args := strings.Join(hlsArgs("abc", transcodeProfiles["aac128"], &hlsInput{path: stdinInput}, output), " ")
+	for _, expected := range []string{
+		"-i pipe:0 -i /tmp/id3 -vn",
+		"-map 0:a:0 -map 1:d:0? -c:d copy",
+		"-metadata artist=A -metadata title=Song",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("args should contain %s, got %s", expected, args)
+		}
+	}
+
+	// timed ID3 cannot be mapped into fMP4 or renditions
+	for profileName, format := range map[string]segmentFormat{"aac128": segmentFMP4, "abr": segmentMPEGTS} {
+		output.format = format
+		args = strings.Join(hlsArgs("abc", transcodeProfiles[profileName], &hlsInput{path: stdinInput}, output), " ")
+		if strings.Contains(args, "/tmp/id3") || !strings.Contains(args, "-metadata artist=A -metadata title=Song") {
+			t.Errorf("args of %s with %s should have tags without timed ID3, got %s", profileName, format, args)
+		}
+	}
+}
+
+func TestHLSArgsSeek(t *testing.T) {
+	dir := "static"
+	originalStaticDirectory := staticDirectory
+	defer func() { staticDirectory = originalStaticDirectory }()
+	staticDirectory = &dir
+
+	job := newSeekJob("abc", transcodeProfiles["abr"], priorityPlay, 5400*time.Second)
+	if job.segmentListFilePath != "static/streams/abc/abr/master.m3u8" {
+		t.Errorf("a seek job should respond with the whole stream, got %s", job.segmentListFilePath)
+	}
+	if job.key() == jobKey("abc", "abr") {
+		t.Error("a seek job should not share a key with a job of the whole stream")
+	}
+
+	args := strings.Join(hlsArgs("abc", job.profile, &hlsInput{path: stdinInput, start: job.start}, &hlsOutput{format: segmentMPEGTS, dirPath: job.dirPath()}), " ")
+	for _, expected := range []string{
+		"-y -ss 5400 -i pipe:0 -vn",
+		"-start_number 540 -hls_time 10",
+		"-hls_segment_filename static/streams/abc/seek/abr/5400/%v/segment%04d.ts",
+		"-f hls static/streams/abc/seek/abr/5400/%v/audio.m3u8",
+	} {
+		if !strings.Contains(args, expected) {
+			t.Errorf("args should contain %s, got %s", expected, args)
+		}
+	}
+}
+
+func TestOpenInputSeek(t *testing.T) {
+	originalSource := jManager.source
+	defer func() { jManager.source = originalSource }()
+
+	job := newSeekJob("abc", transcodeProfiles["aac128"], priorityPlay, 5400*time.Second)
+	workers := &jobWorkers{job: job}
+	defer workers.release()
+	jManager.source = gotubeSource{}
+	if _, _, err := openInput(job, &mediaStream{}, workers); err == nil {
+		t.Error("seek job should fail with a source which cannot seek")
+	}
+	jManager.source = fileSource{dir: "media"}
+	if err := workers.acquireDownload(); err != nil {
+		t.Fatal(err)
+	}
+	input, r, err := openInput(job, &mediaStream{Format: "m4a", MediaType: "audio", handle: "media/abc.m4a"}, workers)
+	if err != nil || r != nil || input.path != "media/abc.m4a" || input.start != job.start {
+		t.Errorf("FFmpeg should read the file from start, got %v, %v, %v", input, r, err)
+	}
+	if workers.downloading || !workers.transcoding {
+		t.Error("seek job reading a file should hold only a FFmpeg worker")
+	}
+}
+
+func TestJobWorkers(t *testing.T) {
+	originalDownloads, originalTranscodes := jManager.downloads, jManager.transcodes
+	defer func() { jManager.downloads, jManager.transcodes = originalDownloads, originalTranscodes }()
+	jManager.downloads, jManager.transcodes = newWorkerPool(1), newWorkerPool(1)
+
+	job := newTranscodeJob("abc", transcodeProfiles["aac128"], priorityPlay)
+	workers := &jobWorkers{job: job}
+	if err := workers.acquireDownload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := workers.acquireTranscode(); err != nil {
+		t.Fatal(err)
+	}
+
+	// another job can download while FFmpeg of the first job is running
+	workers.releaseDownload()
+	workers.releaseDownload()
+	other := &jobWorkers{job: newTranscodeJob("def", transcodeProfiles["aac128"], priorityPlay)}
+	if err := other.acquireDownload(); err != nil {
+		t.Fatal(err)
+	}
+	other.release()
+
+	workers.release()
+	if jManager.downloads.running != 0 || jManager.transcodes.running != 0 {
+		t.Errorf("all workers should be released, got %d downloads and %d transcodes", jManager.downloads.running, jManager.transcodes.running)
+	}
+}
+
+func TestListedDuration(t *testing.T) {
+	f, errTemp := ioutil.TempFile("", "audiube")
+	if errTemp != nil {
+		t.Fatal(errTemp)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10.000000,\nsegment0000.ts\n#EXTINF:4.500000,\nsegment0001.ts\n")
+	f.Close()
+
+	if d := listedDuration(f.Name()); d != 14500*time.Millisecond {
+		t.Errorf("listed duration expected 14.5s, got %s", d)
+	}
+	if d := listedDuration(f.Name() + ".missing"); d != 0 {
+		t.Errorf("listed duration of a missing file expected 0, got %s", d)
+	}
+}
+
+func TestSelectStream(t *testing.T) {
+	webmVideo := &mediaStream{Format: "webm", MediaType: "video", Resolution: "360p"}
+	mp4Video720 := &mediaStream{Format: "mp4", MediaType: "video", Resolution: "720p"}
+	mp4Video360 := &mediaStream{Format: "mp4", MediaType: "video", Resolution: "360p"}
+	mp4Audio := &mediaStream{Format: "mp4", MediaType: "audio", Codec: "mp4a.40.2", Bitrate: 128}
+	webmAudio := &mediaStream{Format: "webm", MediaType: "audio", Codec: "opus", Bitrate: 160}
+	mp4Audio48k := &mediaStream{Format: "mp4", MediaType: "audio", Codec: "mp4a.40.5", Bitrate: 48}
+	mp4Video1080p60 := &mediaStream{Format: "mp4", MediaType: "video", Resolution: "1080p60"}
+	mp4VideoHDR := &mediaStream{Format: "mp4", MediaType: "video", Resolution: "720p HDR"}
+
+	cases := []struct {
+		name     string
+		streams  []*mediaStream
+		policy   selectionPolicy
+		expected *mediaStream
+	}{
+		{"mp4 audio first", []*mediaStream{webmVideo, mp4Video720, mp4Audio}, defaultSelectionPolicy, mp4Audio},
+		{"best audio", []*mediaStream{mp4Audio, mp4Audio48k, mp4Video360}, defaultSelectionPolicy, mp4Audio},
+		{"adaptive video labels", []*mediaStream{mp4Video1080p60, mp4VideoHDR, mp4Video720}, defaultSelectionPolicy, mp4Video720},
+		{"smallest mp4 video", []*mediaStream{webmVideo, mp4Video720, mp4Video360}, defaultSelectionPolicy, mp4Video360},
+		{"fallback to other container", []*mediaStream{webmVideo, webmAudio}, defaultSelectionPolicy, webmAudio},
+		{"prefer muxed", []*mediaStream{mp4Audio, mp4Video720}, selectionPolicy{Containers: []string{"mp4"}, Media: preferMuxed}, mp4Video720},
+		{"codec preference", []*mediaStream{mp4Audio, webmAudio}, selectionPolicy{Media: preferAudio, Codecs: []string{"opus"}}, webmAudio},
+		{"max bitrate", []*mediaStream{webmAudio, mp4Audio}, selectionPolicy{Media: audioOnly, MaxBitrate: 150}, mp4Audio},
+		{"nothing satisfies", []*mediaStream{mp4Video360}, selectionPolicy{Media: audioOnly}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stream, reason, err := selectStream(c.streams, &c.policy)
+			if c.expected == nil {
+				if err == nil {
+					t.Errorf("expected an error, got %v", stream)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stream != c.expected {
+				t.Errorf("stream expected %v, got %v (%s)", *c.expected, *stream, reason)
+			}
+			if reason == "" {
+				t.Error("reason should not be empty")
+			}
+		})
+	}
+}
+
+func TestParseStreamQuality(t *testing.T) {
+	cases := []struct {
+		label    string
+		expected streamQuality
+	}{
+		{"", streamQuality{}},
+		{"480p", streamQuality{Height: 480}},
+		{"1080p60", streamQuality{Height: 1080, FrameRate: 60}},
+		{"720p HDR", streamQuality{Height: 720, HDR: true}},
+		{"2160p60 HDR", streamQuality{Height: 2160, FrameRate: 60, HDR: true}},
+		{"128kbps", streamQuality{Bitrate: 128}},
+		{"44.1kHz", streamQuality{SampleRate: 44100}},
+		{"160kbps 48000Hz", streamQuality{Bitrate: 160, SampleRate: 48000}},
+		{"unknown", streamQuality{}},
+	}
+	for _, c := range cases {
+		if q := parseStreamQuality(c.label); q != c.expected {
+			t.Errorf("quality of %q expected %+v, got %+v", c.label, c.expected, q)
+		}
+	}
+}
+
+func TestStreamScore(t *testing.T) {
+	// each case expects better to score higher than worse
+	cases := []struct {
+		name          string
+		better, worse *mediaStream
+	}{
+		{
+			"higher audio bitrate",
+			&mediaStream{MediaType: "audio", Bitrate: 160},
+			&mediaStream{MediaType: "audio", Bitrate: 128},
+		},
+		{
+			"higher audio sample rate",
+			&mediaStream{MediaType: "audio", Bitrate: 128, SampleRate: 48000},
+			&mediaStream{MediaType: "audio", Bitrate: 128, SampleRate: 44100},
+		},
+		{
+			"bitrate beats sample rate",
+			&mediaStream{MediaType: "audio", Bitrate: 128, SampleRate: 22050},
+			&mediaStream{MediaType: "audio", Bitrate: 64, SampleRate: 48000},
+		},
+		{
+			"audio bitrate in label",
+			&mediaStream{MediaType: "audio", Resolution: "128kbps"},
+			&mediaStream{MediaType: "audio", Resolution: "48kbps"},
+		},
+		{
+			"known audio bitrate",
+			&mediaStream{MediaType: "audio", Bitrate: 48},
+			&mediaStream{MediaType: "audio"},
+		},
+		{
+			"lower video resolution",
+			&mediaStream{MediaType: "video", Resolution: "360p"},
+			&mediaStream{MediaType: "video", Resolution: "720p"},
+		},
+		{
+			"lower frame rate",
+			&mediaStream{MediaType: "video", Resolution: "1080p"},
+			&mediaStream{MediaType: "video", Resolution: "1080p60"},
+		},
+		{
+			"resolution beats frame rate",
+			&mediaStream{MediaType: "video", Resolution: "720p60"},
+			&mediaStream{MediaType: "video", Resolution: "1080p"},
+		},
+		{
+			"SDR",
+			&mediaStream{MediaType: "video", Resolution: "720p"},
+			&mediaStream{MediaType: "video", Resolution: "720p HDR"},
+		},
+		{
+			"known video resolution",
+			&mediaStream{MediaType: "video", Resolution: "2160p60 HDR"},
+			&mediaStream{MediaType: "video", Resolution: ""},
+		},
+	}
+	for _, c := range cases {
+		if b, w := streamScore(c.better), streamScore(c.worse); b <= w {
+			t.Errorf("%s: %+v scored %d, which should be higher than %d of %+v", c.name, *c.better, b, w, *c.worse)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matthewlujp/gotube"
+)
+
+// mediaStream describes one of streams of a video, such as an mp4 audio or a webm video
+type mediaStream struct {
+	Format     string // container, e.g. "mp4", "webm"
+	MediaType  string // "audio" or "video"
+	Resolution string // e.g. "480p", "1080p60", "720p HDR", empty for most of audio
+	Codec      string // audio codec, e.g. "mp4a.40.2", "opus", empty if unknown
+	Bitrate    int    // kbps, 0 if unknown
+	SampleRate int    // Hz, 0 if unknown
+	handle     interface{}
+}
+
+// MediaSource provides streams of videos to the transcode pipeline.
+// It decouples the pipeline from where videos come from, e.g. YouTube or local files.
+type MediaSource interface {
+	// ListStreams returns available streams of a video
+	ListStreams(videoID string) ([]*mediaStream, error)
+	// OpenStream starts fetching a stream. Read returns an error once ctx is done.
+	OpenStream(ctx context.Context, stream *mediaStream) (io.ReadCloser, error)
+	// Duration returns length of a stream
+	Duration(stream *mediaStream) (time.Duration, error)
+}
+
+// seekableSource is a MediaSource whose streams FFmpeg can open by itself, e.g. local files.
+// FFmpeg seeks in such a stream, so transcoding from a position does not read the preceding part.
+// Seek streams are transcoded only from a seekableSource, since other sources are read from the beginning.
+type seekableSource interface {
+	MediaSource
+	// StreamPath returns a path or url of a stream which FFmpeg opens as an input
+	StreamPath(stream *mediaStream) (string, error)
+}
+
+// gotubeSource is a MediaSource fetching videos from YouTube with gotube.
+// gotube downloads a stream only from the beginning, so gotubeSource is not a seekableSource.
+type gotubeSource struct{}
+
+func (gotubeSource) ListStreams(videoID string) ([]*mediaStream, error) {
+	// prepare downloader and collect necessary info
+	downloader, errBuild := gotube.NewDownloader(
+		fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID),
+	)
+	if errBuild != nil {
+		return nil, errBuild
+	}
+	if err := downloader.FetchStreams(); err != nil {
+		return nil, err
+	}
+
+	streams := make([]*mediaStream, 0, len(downloader.Streams))
+	for _, s := range downloader.Streams {
+		// gotube labels some audio streams with bitrate or sample rate instead of resolution
+		q := parseStreamQuality(s.Resolution)
+		streams = append(streams, &mediaStream{
+			Format:     s.Format,
+			MediaType:  s.MediaType,
+			Resolution: s.Resolution,
+			Codec:      youtubeAudioCodec(s.Format, s.MediaType),
+			Bitrate:    q.Bitrate,
+			SampleRate: q.SampleRate,
+			handle:     s,
+		})
+	}
+	return streams, nil
+}
+
+// OpenStream downloads a stream chunk by chunk in a goroutine.
+// Reading is stopped when ctx is done, but gotube cannot be interrupted,
+// so closing the reader discards the rest of chunks to let the download goroutine finish and close its connection.
+func (gotubeSource) OpenStream(ctx context.Context, stream *mediaStream) (io.ReadCloser, error) {
+	s, ok := stream.handle.(*gotube.Stream)
+	if !ok {
+		return nil, fmt.Errorf("stream %v is not provided by gotube", stream)
+	}
+	chunks, err := s.SequentialChunkDownload(10 * time.Second) // conducted in a goroutine
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{ctx: ctx, chunks: chunks}, nil
+}
+
+func (gotubeSource) Duration(stream *mediaStream) (time.Duration, error) {
+	s, ok := stream.handle.(*gotube.Stream)
+	if !ok {
+		return 0, fmt.Errorf("stream %v is not provided by gotube", stream)
+	}
+	return s.Duration, nil
+}
+
+// youtubeAudioCodec infers an audio codec of a YouTube stream from its container, since gotube does not report codecs.
+// YouTube encodes audio of mp4 and 3gp in AAC, audio-only webm in opus, and muxed webm in vorbis.
+func youtubeAudioCodec(format, mediaType string) string {
+	switch format {
+	case "mp4", "3gp":
+		return "mp4a.40.2"
+	case "webm":
+		if mediaType == "audio" {
+			return "opus"
+		}
+		return "vorbis"
+	}
+	return ""
+}
+
+// chunkReader is an io.ReadCloser reading chunks sent through a channel
+type chunkReader struct {
+	ctx    context.Context
+	chunks <-chan []byte
+	buf    []byte
+	closed sync.Once
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		select {
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		case chunk, ok := <-r.chunks:
+			if !ok {
+				// download completed
+				return 0, io.EOF
+			}
+			r.buf = chunk
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close drains chunks not read yet in a goroutine, since a sender blocked on the channel would never exit.
+// It must not be called while Read is running.
+func (r *chunkReader) Close() error {
+	r.closed.Do(func() {
+		go func() {
+			for range r.chunks {
+			}
+		}()
+	})
+	return nil
+}
+
+// fileSource is a MediaSource reading local files in dir.
+// Files of a video are named after its id, e.g. dir/:videoID.mp4, dir/:videoID.m4a.
+type fileSource struct {
+	dir string
+}
+
+// audioExtentions are file extentions regarded as audio by fileSource
+var audioExtentions = map[string]struct{}{
+	"m4a": struct{}{}, "mp3": struct{}{}, "wav": struct{}{}, "opus": struct{}{}, "ogg": struct{}{}, "flac": struct{}{}, "aac": struct{}{},
+}
+
+func (s fileSource) ListStreams(videoID string) ([]*mediaStream, error) {
+	paths, err := filepath.Glob(path.Join(s.dir, videoID+".*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no file for %s in %s", videoID, s.dir)
+	}
+
+	streams := make([]*mediaStream, 0, len(paths))
+	for _, p := range paths {
+		extention := strings.TrimPrefix(filepath.Ext(p), ".")
+		mediaType := "video"
+		if _, ok := audioExtentions[extention]; ok {
+			mediaType = "audio"
+		}
+		streams = append(streams, &mediaStream{Format: extention, MediaType: mediaType, Codec: probeAudioCodec(p), handle: p})
+	}
+	return streams, nil
+}
+
+// probeAudioCodec asks ffprobe for a codec of the first audio stream in a file, which is named as YouTube streams, e.g. "mp4a.40.2" for AAC.
+// An empty string is returned if the codec is unknown.
+func probeAudioCodec(filePath string) string {
+	out, err := exec.Command("ffprobe", "-v", "error", "-select_streams", "a:0", "-show_entries", "stream=codec_name", "-of", "csv=p=0", filePath).Output()
+	if err != nil {
+		return ""
+	}
+	codec := strings.TrimSpace(string(out))
+	if codec == "aac" {
+		return "mp4a.40.2"
+	}
+	return codec
+}
+
+func (s fileSource) OpenStream(ctx context.Context, stream *mediaStream) (io.ReadCloser, error) {
+	p, ok := stream.handle.(string)
+	if !ok {
+		return nil, fmt.Errorf("stream %v is not provided by fileSource", stream)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return &contextReader{ctx: ctx, ReadCloser: f}, nil
+}
+
+// StreamPath returns the file of a stream, which FFmpeg reads from any position
+func (s fileSource) StreamPath(stream *mediaStream) (string, error) {
+	p, ok := stream.handle.(string)
+	if !ok {
+		return "", fmt.Errorf("stream %v is not provided by fileSource", stream)
+	}
+	return p, nil
+}
+
+// Duration asks ffprobe for length of a file
+func (s fileSource) Duration(stream *mediaStream) (time.Duration, error) {
+	p, ok := stream.handle.(string)
+	if !ok {
+		return 0, fmt.Errorf("stream %v is not provided by fileSource", stream)
+	}
+	out, err := exec.Command("ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "csv=p=0", p).Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to probe duration of %s, %s", p, err)
+	}
+	seconds, errParse := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if errParse != nil {
+		return 0, fmt.Errorf("failed to parse duration of %s, %s", p, errParse)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// contextReader is an io.ReadCloser which stops reading once ctx is done
+type contextReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeSineWAV writes a fixture WAV file of a 440Hz sine wave, 16bit mono, lasting seconds
+func writeSineWAV(filePath string, seconds int) error {
+	const sampleRate = 8000
+	samples := make([]int16, sampleRate*seconds)
+	for i := range samples {
+		samples[i] = int16(math.Sin(2*math.Pi*440*float64(i)/sampleRate) * math.MaxInt16 / 2)
+	}
+
+	buf := new(bytes.Buffer)
+	dataSize := uint32(len(samples) * 2)
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, 36+dataSize)
+	buf.WriteString("WAVEfmt ")
+	binary.Write(buf, binary.LittleEndian, struct {
+		ChunkSize     uint32
+		AudioFormat   uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+	}{16, 1, 1, sampleRate, sampleRate * 2, 2, 16}) // 16bit mono PCM
+	buf.WriteString("data")
+	binary.Write(buf, binary.LittleEndian, dataSize)
+	binary.Write(buf, binary.LittleEndian, samples)
+	return ioutil.WriteFile(filePath, buf.Bytes(), 0666)
+}
+
+func TestFileSource(t *testing.T) {
+	dir, errDir := ioutil.TempDir("", "audiube")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+	if err := writeSineWAV(path.Join(dir, "sine.wav"), 1); err != nil {
+		t.Fatal(err)
+	}
+	src := fileSource{dir: dir}
+
+	if _, err := src.ListStreams("missing"); err == nil {
+		t.Error("ListStreams for a missing video should return an error")
+	}
+	streams, errList := src.ListStreams("sine")
+	if errList != nil {
+		t.Fatal(errList)
+	}
+	if len(streams) != 1 || streams[0].Format != "wav" || streams[0].MediaType != "audio" {
+		t.Fatalf("streams expected a wav audio, got %v", streams)
+	}
+	if _, err := exec.LookPath("ffprobe"); err == nil && streams[0].Codec != "pcm_s16le" {
+		t.Errorf("codec of wav expected pcm_s16le, got %s", streams[0].Codec)
+	}
+
+	// read whole file
+	r, errOpen := src.OpenStream(context.Background(), streams[0])
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	b, errRead := ioutil.ReadAll(r)
+	r.Close()
+	if errRead != nil {
+		t.Fatal(errRead)
+	}
+	if len(b) != 44+8000*2 {
+		t.Errorf("size of read data expected %d, got %d", 44+8000*2, len(b))
+	}
+
+	// reading stops when ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	r, errOpen = src.OpenStream(ctx, streams[0])
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	defer r.Close()
+	cancel()
+	if _, err := r.Read(make([]byte, 16)); err != context.Canceled {
+		t.Errorf("read after cancel expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	chunks := make(chan []byte, 2)
+	chunks <- []byte("abc")
+	chunks <- []byte("defg")
+	close(chunks)
+
+	b, err := ioutil.ReadAll(&chunkReader{ctx: context.Background(), chunks: chunks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "abcdefg" {
+		t.Errorf("read data expected %s, got %s", "abcdefg", b)
+	}
+}
+
+func TestChunkReaderClose(t *testing.T) {
+	chunks := make(chan []byte)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		defer close(chunks)
+		for _, chunk := range []string{"abc", "def", "g"} {
+			chunks <- []byte(chunk)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &chunkReader{ctx: ctx, chunks: chunks}
+	if _, err := r.Read(make([]byte, 3)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	r.Close()
+	r.Close()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Error("sender of chunks should finish after the reader is closed")
+	}
+}
+
+func TestYoutubeAudioCodec(t *testing.T) {
+	opus := &mediaStream{Format: "webm", MediaType: "audio", Codec: youtubeAudioCodec("webm", "audio")}
+	aac := &mediaStream{Format: "mp4", MediaType: "audio", Codec: youtubeAudioCodec("mp4", "audio")}
+	policy := selectionPolicy{Media: preferAudio, Codecs: []string{"opus", "mp4a"}}
+	if policy.codecRank(opus) != 0 || policy.codecRank(aac) != 1 {
+		t.Errorf("inferred codecs should be ranked by preference, got %s and %s", opus.Codec, aac.Codec)
+	}
+	if codec := youtubeAudioCodec("webm", "video"); codec != "vorbis" {
+		t.Errorf("codec of muxed webm expected vorbis, got %s", codec)
+	}
+}
+
+// TestBuildHLSFromFile runs the whole pipeline for a fixture file, which requires FFmpeg
+func TestBuildHLSFromFile(t *testing.T) {
+	for _, command := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skipf("%s is not installed", command)
+		}
+	}
+
+	dir, cleanup := withTempStaticDir(t)
+	defer cleanup()
+	if err := writeSineWAV(path.Join(dir, "sine.wav"), 25); err != nil {
+		t.Fatal(err)
+	}
+	originalSource := jManager.source
+	defer func() { jManager.source = originalSource }()
+	jManager.source = fileSource{dir: dir}
+
+	for _, profileName := range []string{"aac128", "abr"} {
+		job := newTranscodeJob("sine", transcodeProfiles[profileName], priorityPlay)
+		if err := fetchVideAndBuildHLS(job); err != nil {
+			t.Fatalf("transcode with %s failed, %s", profileName, err)
+		}
+		if !isCompleteStream("sine", profileName) {
+			t.Errorf("HLS files with %s are not complete", profileName)
+		}
+		metadata := job.getMetadata()
+		if len(metadata) != len(renditionSegmentListFilePaths("sine", job.profile)) {
+			t.Fatalf("metadata of each rendition with %s expected, got %v", profileName, metadata)
+		}
+		if d := metadata[0].duration(); d < 24*time.Second || d > 26*time.Second {
+			t.Errorf("duration with %s expected about 25s, got %s", profileName, d)
+		}
+		if _, err := os.Stat(hlsWaveformFilePath("sine", profileName)); err != nil {
+			t.Errorf("waveform with %s expected, %s", profileName, err)
+		}
+	}
+
+	// sine wave is normalized through a temporary file
+	jManager.loudness = loudnessNormalize
+	defer func() { jManager.loudness = loudnessOff }()
+	job := newTranscodeJob("sine", transcodeProfiles["opus"], priorityPlay)
+	if err := fetchVideAndBuildHLS(job); err != nil {
+		t.Fatalf("transcode with loudness normalization failed, %s", err)
+	}
+	if loudness := job.getLoudness(); loudness == nil || !loudness.Normalized {
+		t.Errorf("loudness of normalized audio expected, got %v", loudness)
+	}
+
+	// fMP4 segments follow an init segment
+	jManager.segmentFormat = segmentFMP4
+	defer func() { jManager.segmentFormat = segmentMPEGTS }()
+	job = newTranscodeJob("sine", transcodeProfiles["aac64"], priorityPlay)
+	if err := fetchVideAndBuildHLS(job); err != nil {
+		t.Fatalf("transcode into fMP4 segments failed, %s", err)
+	}
+	if _, err := os.Stat(path.Join(hlsProfileDirPath("sine", "aac64"), fmp4InitFilename)); err != nil {
+		t.Errorf("init segment expected, %s", err)
+	}
+
+	// encrypted segments are still analyzed locally
+	keysDir := path.Join(dir, "keys")
+	originalKeysDirectory := keysDirectory
+	defer func() { keysDirectory = originalKeysDirectory }()
+	keysDirectory = &keysDir
+	jManager.encrypt = true
+	defer func() { jManager.encrypt = false }()
+	job = newTranscodeJob("sine", transcodeProfiles["aac128"], priorityPlay)
+	if err := fetchVideAndBuildHLS(job); err != nil {
+		t.Fatalf("transcode with encryption failed, %s", err)
+	}
+	if b, _ := ioutil.ReadFile(hlsSegmentListFilePath("sine", "aac128")); !bytes.Contains(b, []byte(`#EXT-X-KEY:METHOD=AES-128,URI="/keys/sine"`)) {
+		t.Errorf("segment list file should refer to the key, got %s", b)
+	}
+	if len(job.getMetadata()) == 0 {
+		t.Error("metadata of encrypted audio expected")
+	}
+	jManager.encrypt = false
+
+	// a single file for download is published after completion
+	job = newTranscodeJob("sine", downloadFormats["m4a"], priorityPlay)
+	if err := fetchVideAndBuildHLS(job); err != nil {
+		t.Fatalf("transcode into a download file failed, %s", err)
+	}
+	if _, err := os.Stat(downloadFilePath("sine", job.profile)); err != nil {
+		t.Errorf("download file expected, %s", err)
+	}
+	if _, err := os.Stat(partialDownloadFilePath("sine", job.profile)); !os.IsNotExist(err) {
+		t.Errorf("partial download file should be renamed, %v", err)
+	}
+
+	// a seek stream is transcoded from a position of the file
+	job = newSeekJob("sine", transcodeProfiles["aac128"], priorityPlay, 10*time.Second)
+	if err := fetchVideAndBuildHLS(job); err != nil {
+		t.Fatalf("transcode from 10s failed, %s", err)
+	}
+	if !isCompleteSeekStream("sine", job.profile, job.start) {
+		t.Error("seek stream is not complete")
+	}
+	if d := listedDuration(job.renditionSegmentListFilePaths()[0]); d < 14*time.Second || d > 16*time.Second {
+		t.Errorf("duration of seek stream expected about 15s, got %s", d)
+	}
+}
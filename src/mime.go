@@ -20,6 +20,17 @@ func name2ContentType(filename string) string {
 			return "text/css"
 		case "m3u8":
 			return "application/x-mpegurl"
+		case "ts":
+			return "video/mp2t"
+		case "m4s", "mp4":
+			// fMP4 segments and init segments of audio
+			return "audio/mp4"
+		case "m4a":
+			return "audio/mp4"
+		case "mp3":
+			return "audio/mpeg"
+		case "opus":
+			return "audio/ogg"
 		default:
 			return "text/plain; charset=utf-8"
 		}
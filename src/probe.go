@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// audioMetadata is properties of transcoded audio reported by ffprobe
+type audioMetadata struct {
+	Rendition     string  `json:"rendition,omitempty"` // name of a rendition, empty for a non adaptive profile
+	Duration      float64 `json:"duration"`            // seconds
+	Codec         string  `json:"codec"`
+	Bitrate       int     `json:"bitrate"`     // kbps, 0 if unknown
+	SampleRate    int     `json:"sample_rate"` // Hz
+	Channels      int     `json:"channels"`
+	ChannelLayout string  `json:"channel_layout"`
+}
+
+// probeOutput is a part of ffprobe json output used to build audioMetadata
+type probeOutput struct {
+	Streams []struct {
+		CodecName     string `json:"codec_name"`
+		SampleRate    string `json:"sample_rate"`
+		Channels      int    `json:"channels"`
+		ChannelLayout string `json:"channel_layout"`
+		BitRate       string `json:"bit_rate"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// probeAudio asks ffprobe for properties of the first audio stream in a file, which may be a segment list file
+func probeAudio(filePath string) (*audioMetadata, error) {
+	args := []string{
+		"-v", "error",
+		"-print_format", "json",
+		"-select_streams", "a:0",
+		"-show_entries", "stream=codec_name,sample_rate,channels,channel_layout,bit_rate:format=duration,bit_rate",
+	}
+	args = append(args, hlsDemuxerOptions(filePath)...)
+	out, err := exec.Command("ffprobe", append(args, filePath)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe %s, %s", filePath, err)
+	}
+	return parseProbeOutput(out)
+}
+
+// parseProbeOutput builds audioMetadata from ffprobe json output.
+// Bitrate of the container is used if that of the audio stream is not reported, which is usual for MPEG-TS.
+func parseProbeOutput(out []byte) (*audioMetadata, error) {
+	var probed probeOutput
+	if err := json.Unmarshal(out, &probed); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output, %s", err)
+	}
+	if len(probed.Streams) == 0 {
+		return nil, fmt.Errorf("no audio stream is found")
+	}
+	s := probed.Streams[0]
+
+	m := &audioMetadata{Codec: s.CodecName, Channels: s.Channels, ChannelLayout: s.ChannelLayout}
+	m.SampleRate, _ = strconv.Atoi(s.SampleRate)
+	m.Duration, _ = strconv.ParseFloat(probed.Format.Duration, 64)
+	bitrate := s.BitRate
+	if bitrate == "" || bitrate == "N/A" {
+		bitrate = probed.Format.BitRate
+	}
+	if bps, err := strconv.Atoi(bitrate); err == nil {
+		m.Bitrate = bps / 1000
+	}
+	return m, nil
+}
+
+// probeStream probes HLS files of a video transcoded with a profile.
+// Each rendition of an adaptive profile is probed separately.
+func probeStream(videoID string, profile *transcodeProfile) ([]*audioMetadata, error) {
+	segmentListFilePaths := renditionSegmentListFilePaths(videoID, profile)
+	metadata := make([]*audioMetadata, 0, len(segmentListFilePaths))
+	for i, segmentListFilePath := range segmentListFilePaths {
+		localFilePath, cleanup, errLocal := localSegmentList(segmentListFilePath)
+		if errLocal != nil {
+			return nil, errLocal
+		}
+		m, err := probeAudio(localFilePath)
+		cleanup()
+		if err != nil {
+			return nil, err
+		}
+		if profile.isAdaptive() {
+			m.Rendition = profile.Renditions[i].Name
+		}
+		metadata = append(metadata, m)
+	}
+	return metadata, nil
+}
+
+// duration returns length of audio as time.Duration
+func (m *audioMetadata) duration() time.Duration {
+	return time.Duration(m.Duration * float64(time.Second))
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseProbeOutput(t *testing.T) {
+	out := []byte(`{
+	"programs": [],
+	"streams": [
+		{"codec_name": "aac", "sample_rate": "44100", "channels": 2, "channel_layout": "stereo"}
+	],
+	"format": {"duration": "212.345000", "bit_rate": "131072"}
+}`)
+	m, err := parseProbeOutput(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := audioMetadata{Duration: 212.345, Codec: "aac", Bitrate: 131, SampleRate: 44100, Channels: 2, ChannelLayout: "stereo"}
+	if *m != expected {
+		t.Errorf("metadata expected %+v, got %+v", expected, *m)
+	}
+
+	// bitrate of the audio stream precedes that of the container
+	out = []byte(`{"streams": [{"codec_name": "opus", "sample_rate": "48000", "channels": 1, "bit_rate": "96000"}], "format": {"duration": "1.0", "bit_rate": "100000"}}`)
+	if m, err = parseProbeOutput(out); err != nil {
+		t.Fatal(err)
+	}
+	if m.Bitrate != 96 {
+		t.Errorf("bitrate expected 96, got %d", m.Bitrate)
+	}
+
+	if _, err := parseProbeOutput([]byte(`{"streams": [], "format": {}}`)); err == nil {
+		t.Error("an error is expected for output without audio stream")
+	}
+}
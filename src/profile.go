@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// transcodeProfile defines codec and bitrate of audio produced by FFmpeg.
+// HLS files of a video are saved in a directory for each profile, i.e. static/streams/:videoID/:profile.
+//
+// A profile with Renditions is adaptive, i.e. each rendition is encoded at once and saved in static/streams/:videoID/:profile/:rendition,
+// and a master playlist listing them is created in static/streams/:videoID/:profile.
+//
+// A profile with Muxer produces a single file for download instead of HLS files, which is saved as static/streams/:videoID/:videoID.:extension.
+type transcodeProfile struct {
+	Name       string
+	Codec      string // FFmpeg audio encoder
+	Bitrate    string // FFmpeg audio bitrate, e.g. "128k"
+	SampleRate string // FFmpeg audio sample rate, kept as source if empty
+	Renditions []*transcodeProfile
+	Muxer      string // FFmpeg muxer of a single file, empty for HLS
+	Extension  string // file extension of a single file
+}
+
+// args returns FFmpeg options to encode an audio stream with the profile.
+// streamSpecifier such as ":0" designates an output audio stream when several renditions are encoded at once.
+func (p *transcodeProfile) args(streamSpecifier string) []string {
+	args := []string{"-c:a" + streamSpecifier, p.Codec, "-b:a" + streamSpecifier, p.Bitrate}
+	if p.SampleRate != "" {
+		// -ar takes a generic stream specifier while -c:a and -b:a already specify audio
+		if streamSpecifier == "" {
+			args = append(args, "-ar", p.SampleRate)
+		} else {
+			args = append(args, "-ar:a"+streamSpecifier, p.SampleRate)
+		}
+	}
+	return args
+}
+
+// isAdaptive reports whether the profile bundles several renditions with a master playlist
+func (p *transcodeProfile) isAdaptive() bool {
+	return len(p.Renditions) > 0
+}
+
+// isFile reports whether the profile produces a single file instead of HLS files
+func (p *transcodeProfile) isFile() bool {
+	return p.Muxer != ""
+}
+
+const (
+	defaultProfileName        = "abr"
+	defaultDownloadFormatName = "m4a"
+)
+
+var (
+	aac64Profile  = &transcodeProfile{Name: "aac64", Codec: "aac", Bitrate: "64k"}
+	aac128Profile = &transcodeProfile{Name: "aac128", Codec: "aac", Bitrate: "128k"}
+	aac256Profile = &transcodeProfile{Name: "aac256", Codec: "aac", Bitrate: "256k"}
+)
+
+// transcodeProfiles are supported profiles which are selectable by server config or request
+var transcodeProfiles = map[string]*transcodeProfile{
+	"aac64":  aac64Profile,
+	"aac128": aac128Profile,
+	"aac256": aac256Profile,
+	"opus":   {Name: "opus", Codec: "libopus", Bitrate: "96k", SampleRate: "48000"}, // opus supports only 48kHz and its divisors
+	"mp3":    {Name: "mp3", Codec: "libmp3lame", Bitrate: "192k"},
+	// adaptive bitrate for players switching quality according to network condition
+	"abr": {Name: "abr", Renditions: []*transcodeProfile{aac64Profile, aac128Profile, aac256Profile}},
+}
+
+// lookupProfile returns a profile with name.
+// An error is returned if name is not a supported profile.
+func lookupProfile(name string) (*transcodeProfile, error) {
+	p, ok := transcodeProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile %s not supported, choose from %s", name, strings.Join(profileNames(), ", "))
+	}
+	return p, nil
+}
+
+// profileNames returns sorted names of supported profiles
+func profileNames() []string {
+	names := make([]string, 0, len(transcodeProfiles))
+	for name := range transcodeProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// downloadFormats are profiles of files for offline listening, selectable by /downloads/:id?format=
+// Their names are distinguished from HLS profiles since they share the job manager.
+var downloadFormats = map[string]*transcodeProfile{
+	"m4a":  {Name: "download-m4a", Codec: "aac", Bitrate: "192k", Muxer: "ipod", Extension: "m4a"}, // ipod muxer writes tags which iTunes and phones read
+	"mp3":  {Name: "download-mp3", Codec: "libmp3lame", Bitrate: "192k", Muxer: "mp3", Extension: "mp3"},
+	"opus": {Name: "download-opus", Codec: "libopus", Bitrate: "128k", SampleRate: "48000", Muxer: "opus", Extension: "opus"},
+}
+
+// lookupDownloadFormat returns a profile of a download format with name.
+// An error is returned if name is not a supported format.
+func lookupDownloadFormat(name string) (*transcodeProfile, error) {
+	p, ok := downloadFormats[name]
+	if !ok {
+		names := make([]string, 0, len(downloadFormats))
+		for n := range downloadFormats {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("format %s not supported, choose from %s", name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
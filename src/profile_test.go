@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLookupProfile(t *testing.T) {
+	p, err := lookupProfile("opus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-c:a", "libopus", "-b:a", "96k", "-ar", "48000"}
+	if !reflect.DeepEqual(p.args(""), expected) {
+		t.Errorf("args of opus expected %v, got %v", expected, p.args(""))
+	}
+	expected = []string{"-c:a:1", "libopus", "-b:a:1", "96k", "-ar:a:1", "48000"}
+	if !reflect.DeepEqual(p.args(":1"), expected) {
+		t.Errorf("args of opus for second stream expected %v, got %v", expected, p.args(":1"))
+	}
+
+	if _, err := lookupProfile("flac"); err == nil {
+		t.Error("unsupported profile flac should return an error")
+	}
+}
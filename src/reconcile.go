@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+// reconcileStreams fixes up HLS files and db left by a previous run which may have died in the middle of transcoding.
+//   1. a directory under static/streams/:videoID whose segment list file lacks #EXT-X-ENDLIST is removed,
+//      and if resume is true, a transcode job for the video and profile is restarted as a prefetch
+//      a download file left with a temporary name is removed as well
+//      seek streams are removed regardless of completion, since whole streams supersede them
+//      HLS files directly under static/streams/:videoID, written before profiles were introduced, are removed
+//   2. a segment list file url in db whose files are not complete is removed from db
+// It is supposed to be called once on startup before accepting requests.
+func reconcileStreams(resume bool) {
+	// db is optional here, reconciliation of files goes on without it
+	sess, errDial := mgo.Dial(mongoURL)
+	if errDial != nil {
+		logger.Printf("failed to connect to db on reconciliation, only files are checked, %s", errDial)
+	} else {
+		defer sess.Close()
+	}
+
+	interrupted := removeIncompleteStreams()
+	for _, s := range interrupted {
+		if sess != nil {
+			if err := unsetSegmentListFileURL(sess, s.videoID, s.profileName); err != nil {
+				logger.Printf("failed to remove segment list file url of %s from db, %s", s.videoID, err)
+			}
+		}
+		if !resume {
+			continue
+		}
+		profile, errProfile := lookupProfile(s.profileName)
+		if errProfile != nil {
+			logger.Printf("cannot resume transcode of %s, %s", s.videoID, errProfile)
+			continue
+		}
+		logger.Printf("resume interrupted transcode of %s with %s", s.videoID, s.profileName)
+		jManager.start(s.videoID, profile, priorityPrefetch)
+	}
+
+	if sess == nil {
+		return
+	}
+	docs, errDocs := getVideoDocsWithSegmentListFileURL(sess)
+	if errDocs != nil {
+		logger.Print(errDocs)
+		return
+	}
+	for _, doc := range docs {
+		if doc.SegmentFileURL == hlsSegmentListFilePath(doc.VideoID, doc.Profile) && isCompleteStream(doc.VideoID, doc.Profile) {
+			continue
+		}
+		logger.Printf("segment list file %s of %s registered in db is not found, remove it from db", doc.SegmentFileURL, doc.VideoID)
+		if err := unsetSegmentListFileURL(sess, doc.VideoID, doc.Profile); err != nil {
+			logger.Printf("failed to remove segment list file url of %s from db, %s", doc.VideoID, err)
+		}
+	}
+}
+
+// interruptedStream identifies HLS files whose transcode was interrupted
+type interruptedStream struct {
+	videoID     string
+	profileName string
+}
+
+// removeIncompleteStreams removes HLS directories of profiles whose segment list file is missing or incomplete,
+// and download files which are not completed.
+// It returns streams whose transcode was interrupted, i.e. whose segment list file exists but is incomplete.
+func removeIncompleteStreams() []interruptedStream {
+	videoEntries, errRead := ioutil.ReadDir(streamsDirPath())
+	if errRead != nil {
+		if !os.IsNotExist(errRead) {
+			logger.Printf("failed to read streams directory, %s", errRead)
+		}
+		return nil
+	}
+
+	interrupted := make([]interruptedStream, 0)
+	for _, videoEntry := range videoEntries {
+		if !videoEntry.IsDir() {
+			continue
+		}
+		videoID := videoEntry.Name()
+		profileEntries, err := ioutil.ReadDir(hlsSaveDirPath(videoID))
+		if err != nil {
+			logger.Printf("failed to read HLS directory of %s, %s", videoID, err)
+			continue
+		}
+
+		for _, profileEntry := range profileEntries {
+			if !profileEntry.IsDir() {
+				switch ext := path.Ext(profileEntry.Name()); {
+				case strings.HasSuffix(profileEntry.Name(), partialFileSuffix):
+					// a download file left in the middle of transcoding is not resumed
+					logger.Printf("remove incomplete download file %s of %s", profileEntry.Name(), videoID)
+					os.Remove(path.Join(hlsSaveDirPath(videoID), profileEntry.Name()))
+				case ext == ".m3u8" || ext == ".ts":
+					// nothing refers to them, and the stream is transcoded again into a profile directory
+					logger.Printf("remove HLS file %s of %s without profile", profileEntry.Name(), videoID)
+					os.Remove(path.Join(hlsSaveDirPath(videoID), profileEntry.Name()))
+				}
+				continue
+			}
+			profileName := profileEntry.Name()
+			if profileName == seekDirName {
+				logger.Printf("remove seek streams of %s", videoID)
+				if err := removeProfileDir(videoID, seekDirName); err != nil {
+					logger.Printf("failed to remove seek streams of %s, %s", videoID, err)
+				}
+				continue
+			}
+			if isCompleteStream(videoID, profileName) {
+				continue
+			}
+
+			if _, err := os.Stat(hlsSegmentListFilePath(videoID, profileName)); err == nil {
+				interrupted = append(interrupted, interruptedStream{videoID: videoID, profileName: profileName})
+			}
+			logger.Printf("remove incomplete HLS files of %s with %s", videoID, profileName)
+			if err := removeProfileDir(videoID, profileName); err != nil {
+				logger.Printf("failed to remove HLS directory of %s, %s", videoID, err)
+			}
+		}
+		if entries, err := ioutil.ReadDir(hlsSaveDirPath(videoID)); err == nil && len(entries) == 0 {
+			// e.g. a video which had only HLS files without profile
+			os.Remove(hlsSaveDirPath(videoID))
+		}
+	}
+	return interrupted
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRemoveIncompleteStreams(t *testing.T) {
+	_, cleanup := withTempStaticDir(t)
+	defer cleanup()
+
+	// complete, interrupted, and empty directories
+	lists := map[string]string{
+		"complete":    "#EXTM3U\n#EXTINF:10.005333,\nsegment0000.ts\n#EXT-X-ENDLIST\n",
+		"interrupted": "#EXTM3U\n#EXTINF:10.005333,\nsegment0000.ts\n",
+		"empty":       "",
+	}
+	for videoID, list := range lists {
+		if err := os.MkdirAll(hlsProfileDirPath(videoID, "aac128"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if list == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(hlsSegmentListFilePath(videoID, "aac128"), []byte(list), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a seek stream is removed even if it is complete
+	seekDir := seekDirPath("complete", "aac128", 5400*time.Second)
+	if err := os.MkdirAll(seekDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(seekDir, segmentListFilename), []byte(lists["complete"]), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// HLS files without profile are removed, while other files of a video are kept
+	legacyFiles := map[string]bool{
+		path.Join(hlsSaveDirPath("legacy"), segmentListFilename): false,
+		path.Join(hlsSaveDirPath("legacy"), "segment0000.ts"):    false,
+		path.Join(hlsSaveDirPath("complete"), "segment0000.ts"):  false,
+		path.Join(hlsSaveDirPath("complete"), coverArtFilename):  true,
+	}
+	if err := os.MkdirAll(hlsSaveDirPath("legacy"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for filePath := range legacyFiles {
+		if err := ioutil.WriteFile(filePath, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []interruptedStream{{videoID: "interrupted", profileName: "aac128"}}
+	if interrupted := removeIncompleteStreams(); !reflect.DeepEqual(interrupted, expected) {
+		t.Errorf("interrupted streams expected %v, got %v", expected, interrupted)
+	}
+	for filePath, shouldExist := range legacyFiles {
+		if _, err := os.Stat(filePath); (err == nil) != shouldExist {
+			t.Errorf("%s should exist: %t, got error %v", filePath, shouldExist, err)
+		}
+	}
+	for videoID, shouldExist := range map[string]bool{"complete": true, "interrupted": false, "empty": false, "legacy": false} {
+		if _, err := os.Stat(hlsSaveDirPath(videoID)); (err == nil) != shouldExist {
+			t.Errorf("directory of %s should exist: %t, got error %v", videoID, shouldExist, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(hlsSaveDirPath("complete"), seekDirName)); !os.IsNotExist(err) {
+		t.Errorf("seek streams should be removed, got error %v", err)
+	}
+}
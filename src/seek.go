@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Seek streams let a listener play from a position which the whole stream has not been transcoded until yet.
+// A seek stream is transcoded from the position into static/streams/:videoID/seek/:profile/:start,
+// and its segments are numbered by slots of seekStep in the whole stream, i.e. the first one is start/seekStep.
+// The segment list file of the whole stream is served with segments of seek streams where it has not reached,
+// and gaps for the rest, so players keep the same playlist while it is filled in background.
+// Once the whole stream is complete, it is served as it is.
+
+// canSeek reports whether a seek stream can be transcoded.
+// FFmpeg has to read the source from the position by itself, and a seek stream cannot follow silence trimming
+// and loudness normalization, which are decided on the whole source.
+func canSeek() bool {
+	_, seekable := jManager.source.(seekableSource)
+	return seekable && !savesSource()
+}
+
+// seekStreamStarts returns positions where seek streams of a video and profile start in ascending order
+func seekStreamStarts(videoID, profileName string) []time.Duration {
+	infos, err := ioutil.ReadDir(path.Join(hlsSaveDirPath(videoID), seekDirName, profileName))
+	if err != nil {
+		return nil
+	}
+	starts := make([]time.Duration, 0, len(infos))
+	for _, info := range infos {
+		seconds, errParse := strconv.ParseInt(info.Name(), 10, 64)
+		if errParse != nil || seconds <= 0 || !info.IsDir() {
+			continue
+		}
+		starts = append(starts, time.Duration(seconds)*time.Second)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	return starts
+}
+
+// filledSegmentList fills a segment list file of the whole stream of a video with segments of seek streams.
+// rel is a path of the file in the profile directory, e.g. aac64/audio.m3u8, and whole and errWhole are the result of reading it.
+// Until FFmpeg writes the master playlist of the whole stream, that of a seek stream is served, which lists the same renditions.
+// Other files such as segment list files of tracks are returned as they are.
+func filledSegmentList(videoID, profileName, rel string, whole []byte, errWhole error) ([]byte, error) {
+	if errWhole == nil && bytes.Contains(whole, []byte("#EXT-X-ENDLIST")) || errWhole != nil && !os.IsNotExist(errWhole) {
+		return whole, errWhole
+	}
+	if _, err := lookupProfile(profileName); err != nil {
+		return whole, errWhole
+	}
+	if rel != masterListFilename && path.Base(rel) != segmentListFilename {
+		return whole, errWhole
+	}
+	starts := seekStreamStarts(videoID, profileName)
+	if len(starts) == 0 {
+		return whole, errWhole
+	}
+
+	if rel == masterListFilename {
+		if errWhole == nil {
+			return whole, nil
+		}
+		for _, start := range starts {
+			if b, err := ioutil.ReadFile(path.Join(seekDirPath(videoID, profileName, start), rel)); err == nil {
+				return b, nil
+			}
+		}
+		return whole, errWhole
+	}
+
+	var parts []*listPart
+	if errWhole == nil {
+		list, err := parseSegmentList(whole, rel)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &listPart{list: list})
+	}
+	wholeDirPath := path.Join(hlsProfileDirPath(videoID, profileName), path.Dir(rel))
+	for _, start := range starts {
+		dirPath := path.Join(seekDirPath(videoID, profileName, start), path.Dir(rel))
+		list, err := readSegmentList(path.Join(dirPath, path.Base(rel)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		prefix, errRel := filepath.Rel(wholeDirPath, dirPath)
+		if errRel != nil {
+			return nil, errRel
+		}
+		parts = append(parts, &listPart{first: int(start / seekStep), list: list, prefix: filepath.ToSlash(prefix)})
+	}
+	if len(parts) == 0 {
+		return whole, errWhole
+	}
+	return mergeSegmentLists(parts), nil
+}
+
+// listPart is a segment list file whose segments fill slots of the whole stream from first
+type listPart struct {
+	first  int
+	list   *segmentList
+	prefix string // path of the directory of the file relative to that of the whole stream, empty for the whole stream itself
+}
+
+// covers reports whether the part has a segment of slot
+func (p *listPart) covers(slot int) bool {
+	return slot >= p.first && slot < p.first+len(p.list.segments)
+}
+
+// mergeSegmentLists builds a segment list file where each slot is listed from the part starting last among those covering it,
+// so that a listed segment of a seek stream is not replaced as the whole stream grows. A slot no part covers is a gap.
+// Parts are encoded separately, so they are separated by discontinuity and carry their own key and init segment.
+// The result never ends, since the whole stream is served as it is when complete.
+func mergeSegmentLists(parts []*listPart) []byte {
+	slots := 0
+	targetDuration := int(seekStep / time.Second)
+	for _, p := range parts {
+		if end := p.first + len(p.list.segments); end > slots {
+			slots = end
+		}
+		for _, tag := range p.list.header {
+			if d, err := strconv.Atoi(strings.TrimPrefix(tag, "#EXT-X-TARGETDURATION:")); err == nil && d > targetDuration {
+				targetDuration = d
+			}
+		}
+	}
+	chosen := make([]*listPart, slots)
+	gaps := false
+	for slot := range chosen {
+		for _, p := range parts {
+			if p.covers(slot) && (chosen[slot] == nil || p.first > chosen[slot].first) {
+				chosen[slot] = p
+			}
+		}
+		gaps = gaps || chosen[slot] == nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	for _, tag := range parts[0].list.header {
+		if strings.HasPrefix(tag, "#EXT-X-TARGETDURATION") || strings.HasPrefix(tag, "#EXT-X-KEY") || strings.HasPrefix(tag, "#EXT-X-MAP") {
+			continue
+		}
+		if strings.HasPrefix(tag, "#EXT-X-VERSION") && gaps {
+			continue
+		}
+		buf.WriteString(tag + "\n")
+	}
+	if gaps {
+		// EXT-X-GAP requires version 8
+		buf.WriteString("#EXT-X-VERSION:8\n")
+	}
+	fmt.Fprintf(&buf, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+
+	for slot, p := range chosen {
+		switched := slot == 0 || p != chosen[slot-1]
+		if slot > 0 && switched {
+			buf.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if p == nil {
+			// players skip a gap, whose uri is never requested
+			fmt.Fprintf(&buf, "#EXT-X-GAP\n#EXTINF:%.6f,\n%s\n", seekStep.Seconds(), fmt.Sprintf(segmentFilename, slot))
+			continue
+		}
+		if switched {
+			for _, tag := range p.list.header {
+				if strings.HasPrefix(tag, "#EXT-X-KEY") || strings.HasPrefix(tag, "#EXT-X-MAP") {
+					buf.WriteString(relocateTag(tag, p.prefix) + "\n")
+				}
+			}
+		}
+		s := p.list.segments[slot-p.first]
+		fmt.Fprintf(&buf, "#EXTINF:%.6f,\n%s\n", s.duration, relocateURI(s.uri, p.prefix))
+	}
+	return buf.Bytes()
+}
+
+// relocateURI makes a relative uri in a segment list file in prefix refer to the same file from the whole stream
+func relocateURI(uri, prefix string) string {
+	if prefix == "" || strings.HasPrefix(uri, "/") || strings.Contains(uri, "://") {
+		return uri
+	}
+	return prefix + "/" + uri
+}
+
+// relocateTag relocates URI attribute of a tag such as #EXT-X-MAP:URI="init.mp4"
+func relocateTag(tag, prefix string) string {
+	const attr = `URI="`
+	i := strings.Index(tag, attr)
+	if i < 0 {
+		return tag
+	}
+	i += len(attr)
+	j := strings.IndexByte(tag[i:], '"')
+	if j < 0 {
+		return tag
+	}
+	return tag[:i] + relocateURI(tag[i:i+j], prefix) + tag[i+j:]
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilledSegmentList(t *testing.T) {
+	_, cleanup := withTempStaticDir(t)
+	defer cleanup()
+
+	header := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n"
+	key := "#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/abc\"\n"
+	whole := header + "#EXT-X-MEDIA-SEQUENCE:0\n" + key + "#EXTINF:10.005333,\nsegment0000.ts\n#EXTINF:9.994667,\nsegment0001.ts\n"
+	seekDir := seekDirPath("abc", "aac128", 50*time.Second)
+	if err := os.MkdirAll(seekDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	seek := header + "#EXT-X-MEDIA-SEQUENCE:5\n" + key + "#EXTINF:10.005333,\nsegment0005.ts\n#EXTINF:10.000000,\nsegment0006.ts\n"
+	if err := ioutil.WriteFile(path.Join(seekDir, segmentListFilename), []byte(seek), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// the whole stream lists slots 0 and 1, the seek stream from 50s lists 5 and 6, and the rest before it are gaps
+	list, err := filledSegmentList("abc", "aac128", segmentListFilename, []byte(whole), nil)
+	expected := "#EXTM3U\n#EXT-X-VERSION:8\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		key + "#EXTINF:10.005333,\nsegment0000.ts\n#EXTINF:9.994667,\nsegment0001.ts\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXT-X-GAP\n#EXTINF:10.000000,\nsegment0002.ts\n#EXT-X-GAP\n#EXTINF:10.000000,\nsegment0003.ts\n#EXT-X-GAP\n#EXTINF:10.000000,\nsegment0004.ts\n" +
+		"#EXT-X-DISCONTINUITY\n" +
+		key + "#EXTINF:10.005333,\n../seek/aac128/50/segment0005.ts\n#EXTINF:10.000000,\n../seek/aac128/50/segment0006.ts\n"
+	if err != nil || string(list) != expected {
+		t.Errorf("filled list expected %q, got %q, %v", expected, list, err)
+	}
+
+	// the whole stream which has not started yet is all gaps until the seek stream
+	list, err = filledSegmentList("abc", "aac128", segmentListFilename, nil, os.ErrNotExist)
+	if err != nil || !strings.HasPrefix(string(list), "#EXTM3U\n#EXT-X-VERSION:8\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-GAP\n") {
+		t.Errorf("list of gaps and the seek stream expected, got %q, %v", list, err)
+	}
+
+	// a complete whole stream and files other than segment list files are served as they are
+	complete := whole + "#EXT-X-ENDLIST\n"
+	if list, err := filledSegmentList("abc", "aac128", segmentListFilename, []byte(complete), nil); err != nil || string(list) != complete {
+		t.Errorf("complete list should be served as it is, got %q, %v", list, err)
+	}
+	if list, err := filledSegmentList("abc", "aac128", "track01.m3u8", []byte(whole), nil); err != nil || string(list) != whole {
+		t.Errorf("track list should be served as it is, got %q, %v", list, err)
+	}
+	if _, err := filledSegmentList("def", "aac128", segmentListFilename, nil, os.ErrNotExist); !os.IsNotExist(err) {
+		t.Errorf("missing list without seek streams should not be found, got %v", err)
+	}
+
+	// a master playlist of a seek stream is served until the whole one is written
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=140800\naac64/audio.m3u8\n"
+	abrSeekDir := seekDirPath("abc", "abr", 50*time.Second)
+	if err := os.MkdirAll(abrSeekDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(abrSeekDir, masterListFilename), []byte(master), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := filledSegmentList("abc", "abr", masterListFilename, nil, os.ErrNotExist); err != nil || string(list) != master {
+		t.Errorf("master playlist of the seek stream expected, got %q, %v", list, err)
+	}
+}
+
+func TestSeekWithoutSeekableSource(t *testing.T) {
+	dir, cleanup := withTempStaticDir(t)
+	defer cleanup()
+	originalSource := jManager.source
+	defer func() { jManager.source = originalSource }()
+
+	jManager.source = gotubeSource{}
+	if canSeek() {
+		t.Error("YouTube streams should not be seekable")
+	}
+	rec := httptest.NewRecorder()
+	streamsHandler(rec, httptest.NewRequest(http.MethodGet, "/streams/abc?start=5400", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("seeking a source which cannot seek expected 409, got %d %s", rec.Code, rec.Body)
+	}
+	if job := jManager.getAt("abc", transcodeProfiles[*defaultProfile], 5400*time.Second); job != nil {
+		t.Error("no seek job should be started")
+	}
+
+	jManager.source = fileSource{dir: dir}
+	if !canSeek() {
+		t.Error("local files should be seekable")
+	}
+}
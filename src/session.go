@@ -0,0 +1,140 @@
+// Keys of encrypted streams are served only to listeners who have a session.
+// A listener starts a session by posting a token given via an environment variable LISTENER_TOKEN to /sessions,
+// and receives a cookie which players send along with requests for keys.
+// The cookie holds its expiry signed with the token, so sessions survive restarts and are revoked by changing the token.
+// If LISTENER_TOKEN is not set, sessions and keys are disabled.
+// A player on another origin has to be listed in -allowed-origins, and send requests to /sessions and /keys with credentials,
+// e.g. withCredentials of XMLHttpRequest. Browsers send the cookie to another site only if it is served over HTTPS,
+// while a player on the same site, e.g. another port, works over HTTP.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "audiube_session"
+	sessionLifetime   = 30 * 24 * time.Hour
+)
+
+var (
+	listenerToken string
+)
+
+func init() {
+	// get listener token from an environment variable
+	listenerToken = os.Getenv("LISTENER_TOKEN")
+}
+
+// signSession builds a cookie value of a session expiring at expires
+func signSession(expires time.Time) string {
+	value := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(listenerToken))
+	mac.Write([]byte(value))
+	return value + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySession reports whether a cookie value is signed with the token and has not expired
+func verifySession(cookieValue string, now time.Time) bool {
+	i := strings.LastIndexByte(cookieValue, '.')
+	if i < 0 {
+		return false
+	}
+	expires, err := strconv.ParseInt(cookieValue[:i], 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(signSession(time.Unix(expires, 0))), []byte(cookieValue))
+}
+
+// withSession rejects a request which does not carry a valid session cookie
+func withSession(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if listenerToken == "" {
+			http.Error(w, "sessions are disabled", http.StatusForbidden)
+			return
+		}
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil || !verifySession(cookie.Value, time.Now()) {
+			http.Error(w, "valid session required", http.StatusUnauthorized)
+			return
+		}
+		f(w, r)
+	}
+}
+
+// POST /sessions
+// DATA
+// {
+// 	"token": "..."  <- LISTENER_TOKEN
+// }
+// RESPONSE
+// {
+// 	"message": "session started",
+// 	"expires": "2018-05-01T12:00:00Z"
+// }
+// DELETE /sessions ends the session of the caller.
+// sessionsHandler starts a session by setting a cookie if the token is correct.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if listenerToken == "" {
+		http.Error(w, "sessions are disabled", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var body struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("failed to parse request body, %s", err), http.StatusBadRequest)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(body.Token), []byte(listenerToken)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		expires := time.Now().Add(sessionLifetime)
+		setSessionCookie(w, r, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    signSession(expires),
+			Path:     "/",
+			Expires:  expires,
+			HttpOnly: true,
+		})
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "session started", "expires": expires.UTC().Format(time.RFC3339)}); err != nil {
+			logger.Printf("failed to write result into ResponseWriter, %s", err)
+		}
+	case http.MethodDelete:
+		setSessionCookie(w, r, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "session ended"}); err != nil {
+			logger.Printf("failed to write result into ResponseWriter, %s", err)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+// setSessionCookie sets a cookie of a session, which is sent from a player on another site if the connection is secure
+// and such players are allowed. Browsers accept SameSite=None only along with Secure,
+// otherwise the cookie falls back to the default of the browser.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, cookie *http.Cookie) {
+	cookie.Secure = r.TLS != nil
+	v := cookie.String()
+	if cookie.Secure && len(credentialedOrigins) > 0 {
+		// http.Cookie has no field for SameSite in Go 1.10
+		v += "; SameSite=None"
+	}
+	w.Header().Add("Set-Cookie", v)
+}
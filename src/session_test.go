@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySession(t *testing.T) {
+	originalToken := listenerToken
+	defer func() { listenerToken = originalToken }()
+	listenerToken = "secret"
+
+	now := time.Now()
+	value := signSession(now.Add(time.Hour))
+	if !verifySession(value, now) {
+		t.Errorf("session %s should be valid", value)
+	}
+	if verifySession(value, now.Add(2*time.Hour)) {
+		t.Error("expired session should be invalid")
+	}
+	if forged := strings.Replace(value, value[:3], "999", 1); verifySession(forged, now) {
+		t.Error("session with a forged expiry should be invalid")
+	}
+	listenerToken = "changed"
+	if verifySession(value, now) {
+		t.Error("session signed with an old token should be invalid")
+	}
+}
+
+func TestSessionsHandler(t *testing.T) {
+	originalToken := listenerToken
+	defer func() { listenerToken = originalToken }()
+	listenerToken = "secret"
+	keyHandler := withSession(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("key")) })
+
+	// wrong token is rejected
+	rec := httptest.NewRecorder()
+	sessionsHandler(rec, httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"token": "wrong"}`)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status with a wrong token expected %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	keyHandler(rec, httptest.NewRequest(http.MethodGet, "/keys/abc", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status without a session expected %d, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	// cookie of a session passes
+	rec = httptest.NewRecorder()
+	sessionsHandler(rec, httptest.NewRequest(http.MethodPost, "/sessions", strings.NewReader(`{"token": "secret"}`)))
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusOK || len(cookies) != 1 {
+		t.Fatalf("session cookie expected, got status %d and %v", rec.Code, cookies)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/keys/abc", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	keyHandler(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "key" {
+		t.Errorf("key expected with a session, got status %d and %s", rec.Code, rec.Body)
+	}
+}
+
+func TestSessionFromAnotherOrigin(t *testing.T) {
+	originalToken := listenerToken
+	defer func() { listenerToken = originalToken }()
+	listenerToken = "secret"
+	originalOrigins := credentialedOrigins
+	defer func() { credentialedOrigins = originalOrigins }()
+	credentialedOrigins = map[string]bool{"https://player.example.com": true}
+	handler := allowCredentialedCORS(sessionsHandler)
+
+	req := httptest.NewRequest(http.MethodOptions, "/sessions", nil)
+	req.Header.Set("Origin", "https://player.example.com")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://player.example.com" || rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("preflight should allow the origin with credentials, got status %d and %v", rec.Code, rec.Header())
+	}
+
+	// any other site must not read keys with cookies of a listener
+	req = httptest.NewRequest(http.MethodGet, "/keys/abc", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	rec = httptest.NewRecorder()
+	allowCredentialedCORS(func(w http.ResponseWriter, r *http.Request) {})(rec, req)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("origin not allowed should get no CORS headers, got %v", rec.Header())
+	}
+
+	// cookie over HTTPS is sent to another site
+	req = httptest.NewRequest(http.MethodPost, "https://audiube.example.com/sessions", strings.NewReader(`{"token": "secret"}`))
+	req.Header.Set("Origin", "https://player.example.com")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if cookie := rec.Header().Get("Set-Cookie"); !strings.Contains(cookie, "Secure") || !strings.HasSuffix(cookie, "SameSite=None") {
+		t.Errorf("secure cookie with SameSite=None expected, got %s", cookie)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSilenceThreshold   = -50.0           // dB
+	defaultSilenceMinDuration = 2 * time.Second // shorter silence is a pause of music
+)
+
+// silenceTrimConfig decides what is regarded as silence to trim at the start and end of audio
+type silenceTrimConfig struct {
+	Threshold   float64       // dB, audio quieter than it is silent
+	MinDuration time.Duration // silence shorter than it is kept
+}
+
+// validate checks the config is acceptable for silencedetect
+func (c *silenceTrimConfig) validate() error {
+	if c.Threshold >= 0 {
+		return fmt.Errorf("silence threshold %.1fdB must be negative", c.Threshold)
+	}
+	if c.MinDuration <= 0 {
+		return fmt.Errorf("minimum duration of silence %s must be positive", c.MinDuration)
+	}
+	return nil
+}
+
+// silenceInterval is a silent part of audio in seconds.
+// End is +Inf if silence lasts until the end.
+type silenceInterval struct {
+	Start float64
+	End   float64
+}
+
+// trimInfo records how silence is trimmed from audio, in seconds
+type trimInfo struct {
+	OriginalDuration float64 `json:"original_duration"`
+	TrimmedDuration  float64 `json:"trimmed_duration"`
+	Start            float64 `json:"start"` // position in the original audio where the trimmed audio starts
+	End              float64 `json:"end"`   // position in the original audio where the trimmed audio ends
+}
+
+// detectSilence runs silencedetect over a whole file
+func detectSilence(ctx context.Context, filePath string, c *silenceTrimConfig) ([]silenceInterval, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner", "-nostats",
+		"-i", filePath,
+		"-vn",
+		"-af", fmt.Sprintf("silencedetect=noise=%.1fdB:d=%.3f", c.Threshold, c.MinDuration.Seconds()),
+		"-f", "null", "-",
+	)
+	// silence is reported throughout the log, which is short without stats
+	var log bytes.Buffer
+	stderr := &tailBuffer{limit: ffmpegLogTailSize}
+	cmd.Stderr = io.MultiWriter(&log, stderr)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to detect silence of %s, %s, %s", filePath, err, stderr)
+	}
+	return parseSilenceDetectOutput(log.Bytes()), nil
+}
+
+// parseSilenceDetectOutput extracts silent intervals from FFmpeg log lines such as
+//   [silencedetect @ 0x7f8] silence_start: 0
+//   [silencedetect @ 0x7f8] silence_end: 3.412 | silence_duration: 3.412
+// The last interval is open if silence lasts until the end.
+func parseSilenceDetectOutput(log []byte) []silenceInterval {
+	intervals := make([]silenceInterval, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(log))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "silence_start: "); i >= 0 {
+			if start, err := strconv.ParseFloat(strings.Fields(line[i+len("silence_start: "):])[0], 64); err == nil {
+				intervals = append(intervals, silenceInterval{Start: start, End: math.Inf(1)})
+			}
+		} else if i := strings.Index(line, "silence_end: "); i >= 0 && len(intervals) > 0 {
+			if end, err := strconv.ParseFloat(strings.Fields(line[i+len("silence_end: "):])[0], 64); err == nil {
+				intervals[len(intervals)-1].End = end
+			}
+		}
+	}
+	return intervals
+}
+
+// silenceEdgeTolerance is seconds from the start or the end of audio where silence is regarded as leading or trailing
+const silenceEdgeTolerance = 0.1
+
+// trimSilence decides a part of audio lasting duration seconds to keep,
+// i.e. after leading silence and before trailing silence.
+func trimSilence(intervals []silenceInterval, duration float64) *trimInfo {
+	t := &trimInfo{OriginalDuration: duration, Start: 0, End: duration}
+	if len(intervals) > 0 && intervals[0].Start <= silenceEdgeTolerance {
+		t.Start = math.Min(intervals[0].End, duration)
+	}
+	if len(intervals) > 0 {
+		if last := intervals[len(intervals)-1]; last.End >= duration-silenceEdgeTolerance && last.Start > t.Start {
+			t.End = last.Start
+		}
+	}
+	if t.End <= t.Start {
+		// whole audio is silent, keep it as it is
+		t.Start, t.End = 0, duration
+	}
+	t.TrimmedDuration = t.End - t.Start
+	return t
+}
+
+// filter builds FFmpeg audio filters cutting out the trimmed part, which is empty if nothing is trimmed
+func (t *trimInfo) filter() string {
+	if t.Start == 0 && t.End == t.OriginalDuration {
+		return ""
+	}
+	return fmt.Sprintf("atrim=start=%.3f:end=%.3f,asetpts=PTS-STARTPTS", t.Start, t.End)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseSilenceDetectOutput(t *testing.T) {
+	log := []byte(`Input #0, wav, from 'sine.wav':
+[silencedetect @ 0x55e1c8a4e700] silence_start: 0
+[silencedetect @ 0x55e1c8a4e700] silence_end: 3.412 | silence_duration: 3.412
+[silencedetect @ 0x55e1c8a4e700] silence_start: 95.2
+[silencedetect @ 0x55e1c8a4e700] silence_end: 97.5 | silence_duration: 2.3
+[silencedetect @ 0x55e1c8a4e700] silence_start: 210.08
+size=N/A time=00:03:35.00 bitrate=N/A speed= 512x
+`)
+	intervals := parseSilenceDetectOutput(log)
+	expected := []silenceInterval{{0, 3.412}, {95.2, 97.5}, {210.08, math.Inf(1)}}
+	if len(intervals) != len(expected) {
+		t.Fatalf("intervals expected %v, got %v", expected, intervals)
+	}
+	for i := range expected {
+		if intervals[i] != expected[i] {
+			t.Errorf("interval %d expected %v, got %v", i, expected[i], intervals[i])
+		}
+	}
+}
+
+func TestTrimSilence(t *testing.T) {
+	cases := []struct {
+		name       string
+		intervals  []silenceInterval
+		start, end float64
+	}{
+		{"no silence", nil, 0, 215},
+		{"leading and trailing", []silenceInterval{{0, 3.5}, {95.2, 97.5}, {210, math.Inf(1)}}, 3.5, 210},
+		{"trailing until the end", []silenceInterval{{200, 215}}, 0, 200},
+		{"silence in the middle", []silenceInterval{{95.2, 97.5}}, 0, 215},
+		{"all silent", []silenceInterval{{0, math.Inf(1)}}, 0, 215},
+	}
+	for _, c := range cases {
+		trim := trimSilence(c.intervals, 215)
+		if trim.Start != c.start || trim.End != c.end || trim.TrimmedDuration != c.end-c.start || trim.OriginalDuration != 215 {
+			t.Errorf("%s: trimming %v-%v expected, got %+v", c.name, c.start, c.end, *trim)
+		}
+		if (trim.filter() == "") != (c.start == 0 && c.end == 215) {
+			t.Errorf("%s: unexpected filter %q", c.name, trim.filter())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	youtube "github.com/matthewlujp/audiube/src/youtube_data_v3"
+	mgo "gopkg.in/mgo.v2"
+)
+
+const (
+	coverArtFilename = "cover.jpg" // thumbnail of a video saved in static/streams/:videoID, YouTube thumbnails are jpeg
+	coverArtMaxSize  = 10 << 20    // bytes, a thumbnail larger than it is truncated
+)
+
+// coverArtMuxers are muxers of download files which can embed cover art as an attached picture.
+// Ogg muxer of FFmpeg does not support it, so opus files carry tags only.
+var coverArtMuxers = map[string]bool{"ipod": true, "mp3": true}
+
+// audioTags are tags and cover art written into a download file
+type audioTags struct {
+	values    map[string]string // FFmpeg metadata such as title and artist
+	coverPath string            // image file embedded as cover art, empty if none
+}
+
+// jobTags prepares tags of a video transcoded by job from its YouTube info saved in db, and downloads cover art if the profile can embed it.
+// Tags are informative, so empty tags are returned on failure as well as for a video which is not on YouTube.
+func jobTags(job *transcodeJob) *audioTags {
+	tags := &audioTags{values: make(map[string]string)}
+	if _, ok := jManager.source.(gotubeSource); !ok {
+		return tags
+	}
+	var sess *mgo.Session
+	if s, errDial := mgo.Dial(mongoURL); errDial == nil {
+		defer s.Close()
+		sess = s
+	} else {
+		logger.Printf("failed to connect to db to find info of %s, %s", job.videoID, errDial)
+	}
+	video, err := videoInfo(sess, job.videoID, job.profile.Name)
+	if err != nil {
+		logger.Printf("failed to get info of %s to tag audio, %s", job.videoID, err)
+		return tags
+	}
+	tags.values = videoTags(video)
+
+	if coverArtMuxers[job.profile.Muxer] {
+		coverPath, errCover := saveCoverArt(job.ctx, job.videoID, video.Thumbnails.Largest())
+		if errCover != nil {
+			logger.Printf("failed to save cover art of %s, %s", job.videoID, errCover)
+			return tags
+		}
+		tags.coverPath = coverPath
+	}
+	return tags
+}
+
+// videoInfo returns info of a video saved in db, otherwise fetches it from YouTube and saves it for tracks and later jobs.
+// sess is nil if db is unavailable, then info is always fetched.
+func videoInfo(sess *mgo.Session, videoID, profileName string) (*youtube.Video, error) {
+	if sess != nil {
+		if video, err := getVideoInfoFromDB(sess, videoID); err == nil {
+			return video, nil
+		}
+	}
+	video, err := youtube.DefaultVideoClient.Get(videoID)
+	if err != nil {
+		return nil, err
+	}
+	if sess != nil {
+		if err := setVideoInfo(sess, videoID, profileName, video); err != nil {
+			logger.Printf("failed to save info of %s in db, %s", videoID, err)
+		}
+	}
+	return video, nil
+}
+
+// videoTags converts info of a video into FFmpeg metadata, where the channel is regarded as an artist
+func videoTags(video *youtube.Video) map[string]string {
+	tags := map[string]string{
+		"title":   video.Title,
+		"artist":  video.Channel,
+		"comment": "https://www.youtube.com/watch?v=" + video.ID,
+	}
+	if len(video.PublishDate) >= 4 {
+		// publish date is yyyy-mm-dd, and ID3v2.3 keeps only a year
+		tags["date"] = video.PublishDate[:4]
+	}
+	for key, value := range tags {
+		if value == "" {
+			delete(tags, key)
+		}
+	}
+	return tags
+}
+
+// saveCoverArt downloads a thumbnail of a video into static/streams/:videoID, and returns its path.
+// A thumbnail saved before is reused.
+func saveCoverArt(ctx context.Context, videoID string, thumbnail youtube.ThumbnailDetail) (string, error) {
+	coverPath := path.Join(hlsSaveDirPath(videoID), coverArtFilename)
+	if _, err := os.Stat(coverPath); err == nil {
+		return coverPath, nil
+	}
+	if thumbnail.URL == "" {
+		return "", fmt.Errorf("%s has no thumbnail", videoID)
+	}
+
+	req, errReq := http.NewRequest(http.MethodGet, thumbnail.URL, nil)
+	if errReq != nil {
+		return "", errReq
+	}
+	resp, errDo := http.DefaultClient.Do(req.WithContext(ctx))
+	if errDo != nil {
+		return "", errDo
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("thumbnail %s responded with %s", thumbnail.URL, resp.Status)
+	}
+
+	// the thumbnail is renamed after it is complete, as well as a download file
+	f, errCreate := os.Create(coverPath + partialFileSuffix)
+	if errCreate != nil {
+		return "", errCreate
+	}
+	_, errCopy := io.Copy(f, io.LimitReader(resp.Body, coverArtMaxSize))
+	f.Close()
+	if errCopy != nil {
+		os.Remove(f.Name())
+		return "", errCopy
+	}
+	return coverPath, os.Rename(f.Name(), coverPath)
+}
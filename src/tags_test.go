@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	youtube "github.com/matthewlujp/audiube/src/youtube_data_v3"
+)
+
+func TestVideoTags(t *testing.T) {
+	video := &youtube.Video{ID: "abc", Title: "Song A", Channel: "Artist B", PublishDate: "2018-03-28"}
+	expected := map[string]string{"title": "Song A", "artist": "Artist B", "date": "2018", "comment": "https://www.youtube.com/watch?v=abc"}
+	if tags := videoTags(video); !reflect.DeepEqual(tags, expected) {
+		t.Errorf("tags expected %v, got %v", expected, tags)
+	}
+
+	// missing info is not tagged
+	expected = map[string]string{"title": "Song A", "comment": "https://www.youtube.com/watch?v=abc"}
+	if tags := videoTags(&youtube.Video{ID: "abc", Title: "Song A"}); !reflect.DeepEqual(tags, expected) {
+		t.Errorf("tags without channel and date expected %v, got %v", expected, tags)
+	}
+}
+
+func TestSaveCoverArt(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("jpeg"))
+	}))
+	defer server.Close()
+
+	_, cleanup := withTempStaticDir(t)
+	defer cleanup()
+	if err := os.MkdirAll(hlsSaveDirPath("abc"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// the thumbnail is downloaded once and reused
+	for i := 0; i < 2; i++ {
+		coverPath, err := saveCoverArt(context.Background(), "abc", youtube.ThumbnailDetail{URL: server.URL + "/maxresdefault.jpg"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadFile(coverPath); string(b) != "jpeg" {
+			t.Errorf("saved cover art expected %s, got %s", "jpeg", b)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("thumbnail expected to be downloaded once, got %d times", requests)
+	}
+
+	if _, err := saveCoverArt(context.Background(), "def", youtube.ThumbnailDetail{}); err == nil {
+		t.Error("saving cover art without a thumbnail should return an error")
+	}
+}
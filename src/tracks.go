@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	youtube "github.com/matthewlujp/audiube/src/youtube_data_v3"
+)
+
+const (
+	trackListFilename       = "track%02d.m3u8"        // segment list file of a track in a rendition directory
+	trackMasterListFilename = "master_track%02d.m3u8" // master playlist of a track of an adaptive profile
+)
+
+// track is a part of a stream corresponding to a chapter of a video, e.g. a song of an album.
+// Start and End are seconds from the beginning of the stream, which is useful to seek in the whole stream.
+type track struct {
+	Title              string  `json:"title"`
+	Start              float64 `json:"start"`
+	End                float64 `json:"end"`
+	SegmentListFileURL string  `json:"segment_list_file_url"`
+}
+
+// mediaSegment is a segment listed in a segment list file
+type mediaSegment struct {
+	uri      string
+	start    float64 // seconds from the beginning of the stream
+	duration float64
+}
+
+// segmentList is a parsed segment list file
+type segmentList struct {
+	header   []string // tags preceding segments which are common to the whole stream, e.g. #EXT-X-TARGETDURATION
+	segments []mediaSegment
+}
+
+// readSegmentList parses a segment list file written by FFmpeg
+func readSegmentList(segmentListFilePath string) (*segmentList, error) {
+	b, err := ioutil.ReadFile(segmentListFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return parseSegmentList(b, segmentListFilePath)
+}
+
+// parseSegmentList parses content of a segment list file, whose path is used only in errors
+func parseSegmentList(b []byte, segmentListFilePath string) (*segmentList, error) {
+	list := &segmentList{}
+	position, duration := 0.0, -1.0
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line == "#EXTM3U" || line == "#EXT-X-ENDLIST":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// "#EXTINF:10.000000,"
+			d, errParse := strconv.ParseFloat(strings.Split(strings.TrimPrefix(line, "#EXTINF:"), ",")[0], 64)
+			if errParse != nil {
+				return nil, fmt.Errorf("failed to parse %s in %s, %s", line, segmentListFilePath, errParse)
+			}
+			duration = d
+		case !strings.HasPrefix(line, "#"):
+			// uri of a segment follows #EXTINF
+			if duration < 0 {
+				return nil, fmt.Errorf("segment %s lacks duration in %s", line, segmentListFilePath)
+			}
+			list.segments = append(list.segments, mediaSegment{uri: line, start: position, duration: duration})
+			position += duration
+			duration = -1
+		case len(list.segments) == 0 && !strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE") && !strings.HasPrefix(line, "#EXT-X-PLAYLIST-TYPE"):
+			list.header = append(list.header, line)
+		}
+	}
+	return list, nil
+}
+
+// sub builds a segment list file of segments overlapping with [start, end) seconds.
+// Segments are not cut, so the playlist starts at start with EXT-X-START and may last a bit longer than end.
+func (l *segmentList) sub(start, end float64) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	for _, tag := range l.header {
+		if strings.HasPrefix(tag, "#EXT-X-VERSION") {
+			// EXT-X-START requires version 6
+			continue
+		}
+		buf.WriteString(tag + "\n")
+	}
+	buf.WriteString("#EXT-X-VERSION:6\n")
+	buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+
+	first := true
+	for i, s := range l.segments {
+		if s.start+s.duration <= start || s.start >= end {
+			continue
+		}
+		if first {
+			fmt.Fprintf(&buf, "#EXT-X-MEDIA-SEQUENCE:%d\n", i)
+			fmt.Fprintf(&buf, "#EXT-X-START:TIME-OFFSET=%.3f,PRECISE=YES\n", math.Max(start-s.start, 0))
+			first = false
+		}
+		fmt.Fprintf(&buf, "#EXTINF:%.6f,\n%s\n", s.duration, s.uri)
+	}
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.Bytes()
+}
+
+// writeTracks splits a complete stream of a video transcoded with a profile into tracks by chapters.
+// offset is seconds trimmed from the beginning of the source, by which chapters are shifted.
+// Segments are shared with the whole stream, and each track has a segment list file listing a part of them,
+// as well as a master playlist for an adaptive profile.
+// Files are written only if they do not exist yet.
+func writeTracks(videoID string, profile *transcodeProfile, chapters []youtube.Chapter, offset float64) ([]*track, error) {
+	segmentListFilePaths := renditionSegmentListFilePaths(videoID, profile)
+	lists := make([]*segmentList, 0, len(segmentListFilePaths))
+	for _, segmentListFilePath := range segmentListFilePaths {
+		list, err := readSegmentList(segmentListFilePath)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	var length float64
+	if segments := lists[0].segments; len(segments) > 0 {
+		length = segments[len(segments)-1].start + segments[len(segments)-1].duration
+	}
+
+	tracks := make([]*track, 0, len(chapters))
+	for i, chapter := range chapters {
+		n := i + 1 // track number starts from 1
+		start := math.Max(chapter.Start.Seconds()-offset, 0)
+		end := math.Min(chapter.End.Seconds()-offset, length)
+		if chapter.End == 0 {
+			end = length
+		}
+		if end <= start {
+			// trimmed out
+			continue
+		}
+
+		t := &track{Title: chapter.Title, Start: start, End: end, SegmentListFileURL: hlsTrackListFilePath(videoID, profile, n)}
+		tracks = append(tracks, t)
+		if _, err := os.Stat(t.SegmentListFileURL); err == nil {
+			continue
+		}
+		for j, list := range lists {
+			trackListFilePath := path.Join(path.Dir(segmentListFilePaths[j]), fmt.Sprintf(trackListFilename, n))
+			if err := ioutil.WriteFile(trackListFilePath, list.sub(start, end), 0666); err != nil {
+				return nil, fmt.Errorf("failed to write segment list file of track %d of %s, %s", n, videoID, err)
+			}
+		}
+		if profile.isAdaptive() {
+			// master playlist of the track lists segment list files of the track instead of the whole stream
+			master, err := ioutil.ReadFile(hlsSegmentListFilePath(videoID, profile.Name))
+			if err != nil {
+				return nil, err
+			}
+			master = bytes.Replace(master, []byte("/"+segmentListFilename), []byte("/"+fmt.Sprintf(trackListFilename, n)), -1)
+			if err := ioutil.WriteFile(t.SegmentListFileURL, master, 0666); err != nil {
+				return nil, fmt.Errorf("failed to write master playlist of track %d of %s, %s", n, videoID, err)
+			}
+		}
+	}
+	return tracks, nil
+}
+
+// hlsTrackListFilePath returns a path of a segment list file of nth track of a video transcoded with a profile,
+// which is a master playlist for an adaptive profile
+func hlsTrackListFilePath(videoID string, profile *transcodeProfile, n int) string {
+	if profile.isAdaptive() {
+		return path.Join(hlsProfileDirPath(videoID, profile.Name), fmt.Sprintf(trackMasterListFilename, n)) // static/streams/videoID/profile/master_track01.m3u8
+	}
+	return path.Join(hlsProfileDirPath(videoID, profile.Name), fmt.Sprintf(trackListFilename, n)) // static/streams/videoID/profile/track01.m3u8
+}
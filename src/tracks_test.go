@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	youtube "github.com/matthewlujp/audiube/src/youtube_data_v3"
+)
+
+func TestWriteTracks(t *testing.T) {
+	_, cleanup := withTempStaticDir(t)
+	defer cleanup()
+
+	// adaptive stream of 4 segments lasting 35 seconds
+	list := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXTINF:10.000000,\nsegment0000.ts\n#EXTINF:10.000000,\nsegment0001.ts\n#EXTINF:10.000000,\nsegment0002.ts\n#EXTINF:5.000000,\nsegment0003.ts\n#EXT-X-ENDLIST\n"
+	profile := transcodeProfiles["abr"]
+	for _, segmentListFilePath := range renditionSegmentListFilePaths("album", profile) {
+		if err := os.MkdirAll(path.Dir(segmentListFilePath), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(segmentListFilePath, []byte(list), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	master := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=140800,CODECS=\"mp4a.40.2\"\naac128/audio.m3u8\n"
+	if err := ioutil.WriteFile(hlsSegmentListFilePath("album", profile.Name), []byte(master), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	chapters := []youtube.Chapter{
+		{Title: "Intro", Start: 0, End: 3 * time.Second},
+		{Title: "Song", Start: 3 * time.Second, End: 25 * time.Second},
+		{Title: "Outro", Start: 25 * time.Second, End: 40 * time.Second},
+	}
+	// the first 5 seconds are trimmed, which drops Intro, and tracks are numbered after chapters
+	tracks, err := writeTracks("album", profile, chapters, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 2 {
+		t.Fatalf("2 tracks expected, got %d", len(tracks))
+	}
+	if tracks[0].Title != "Song" || tracks[0].Start != 0 || tracks[0].End != 20 {
+		t.Errorf("unexpected first track %+v", *tracks[0])
+	}
+	if tracks[1].Title != "Outro" || tracks[1].Start != 20 || tracks[1].End != 35 {
+		t.Errorf("unexpected second track %+v", *tracks[1])
+	}
+
+	b, errRead := ioutil.ReadFile(tracks[1].SegmentListFileURL)
+	if errRead != nil {
+		t.Fatal(errRead)
+	}
+	if !strings.Contains(string(b), "aac128/track03.m3u8") {
+		t.Errorf("master playlist of a track should list segment list files of the track, got %s", b)
+	}
+	b, errRead = ioutil.ReadFile(path.Join(hlsProfileDirPath("album", profile.Name), "aac64", "track03.m3u8"))
+	if errRead != nil {
+		t.Fatal(errRead)
+	}
+	for _, expected := range []string{
+		"#EXT-X-TARGETDURATION:10\n",
+		"#EXT-X-MEDIA-SEQUENCE:2\n#EXT-X-START:TIME-OFFSET=0.000,PRECISE=YES\n#EXTINF:10.000000,\nsegment0002.ts\n#EXTINF:5.000000,\nsegment0003.ts\n#EXT-X-ENDLIST\n",
+	} {
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("segment list file of a track should contain %q, got %s", expected, b)
+		}
+	}
+	if strings.Contains(string(b), "segment0001.ts") {
+		t.Errorf("segment list file of a track should not contain segments of other tracks, got %s", b)
+	}
+}
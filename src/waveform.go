@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+)
+
+const (
+	waveformFilename          = "waveform.json" // saved next to a segment list file or a master playlist
+	defaultWaveformResolution = 10              // peaks per second
+	waveformSampleRate        = 8000            // Hz, audio is decoded at a low rate since peaks need no detail
+	waveformMaxPeak           = 255             // peaks are scaled into [0, waveformMaxPeak]
+)
+
+// waveform is an amplitude summary of audio for a seek bar.
+// Each peak is the maximum absolute amplitude in 1/Resolution seconds, scaled into [0, 255] where 255 is full scale.
+type waveform struct {
+	Resolution int     `json:"resolution"` // peaks per second
+	Duration   float64 `json:"duration"`   // seconds
+	Peaks      []int   `json:"peaks"`
+}
+
+// writeWaveform generates a waveform of a video transcoded with a profile and saves it in json.
+// For an adaptive profile, the first rendition is analyzed since every rendition has the same waveform.
+func writeWaveform(ctx context.Context, videoID string, profile *transcodeProfile, resolution int) error {
+	segmentListFilePath, cleanup, errLocal := localSegmentList(renditionSegmentListFilePaths(videoID, profile)[0])
+	if errLocal != nil {
+		return errLocal
+	}
+	defer cleanup()
+	w, err := generateWaveform(ctx, segmentListFilePath, resolution)
+	if err != nil {
+		return err
+	}
+	b, errMarshal := json.Marshal(w)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	// the file is renamed after it is complete, so that a request does not read a partial one
+	waveformFilePath := hlsWaveformFilePath(videoID, profile.Name)
+	if err := ioutil.WriteFile(waveformFilePath+partialFileSuffix, b, 0666); err != nil {
+		return fmt.Errorf("failed to write waveform of %s, %s", videoID, err)
+	}
+	return os.Rename(waveformFilePath+partialFileSuffix, waveformFilePath)
+}
+
+// waveformJob generates a waveform of a stream built before, which is shared by concurrent requests for it
+type waveformJob struct {
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+// generateWaveformOf generates a waveform of a video transcoded with a profile by a worker of FFmpeg, and waits for it.
+// Generation runs as a job in the worker pool of transcodes, and a request while it is in progress waits for the same job.
+// The job goes on even if ctx is done, so that the waveform is ready for the next request.
+func (jm *jobManager) generateWaveformOf(ctx context.Context, videoID string, profile *transcodeProfile) error {
+	key := jobKey(videoID, profile.Name)
+	jm.lock.Lock()
+	w, ok := jm.waveforms[key]
+	if !ok {
+		w = &waveformJob{done: make(chan struct{})}
+		jm.waveforms[key] = w
+		go func() {
+			w.err = jm.runWaveformJob(videoID, profile)
+			jm.lock.Lock()
+			delete(jm.waveforms, key)
+			jm.lock.Unlock()
+			close(w.done)
+		}()
+	}
+	jm.lock.Unlock()
+
+	select {
+	case <-w.done:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runWaveformJob waits for a worker of FFmpeg as a job a user is waiting for, and writes a waveform
+func (jm *jobManager) runWaveformJob(videoID string, profile *transcodeProfile) error {
+	job := newTranscodeJob(videoID, profile, priorityPlay)
+	defer job.cancelFunc()
+	if err := jm.transcodes.acquire(job.ctx, job); err != nil {
+		return err
+	}
+	defer jm.transcodes.release()
+	return writeWaveform(job.ctx, videoID, profile, jm.waveform)
+}
+
+// generateWaveform decodes audio into mono PCM with FFmpeg and summarizes it into peaks
+func generateWaveform(ctx context.Context, filePath string, resolution int) (*waveform, error) {
+	args := append([]string{"-hide_banner", "-nostats"}, hlsDemuxerOptions(filePath)...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", append(args,
+		"-i", filePath,
+		"-vn",
+		"-ac", "1",
+		"-ar", fmt.Sprintf("%d", waveformSampleRate),
+		"-f", "s16le", "-",
+	)...)
+	stderr := &tailBuffer{limit: ffmpegLogTailSize}
+	cmd.Stderr = stderr
+	stdout, errPipe := cmd.StdoutPipe()
+	if errPipe != nil {
+		return nil, errPipe
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start FFmpeg, %s", err)
+	}
+
+	w, errPeaks := computePeaks(stdout, waveformSampleRate, resolution)
+	if errPeaks != nil {
+		// FFmpeg blocks on writing unless stdout is drained
+		io.Copy(ioutil.Discard, stdout)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("failed to decode %s for waveform, %s, %s", filePath, err, stderr)
+	}
+	return w, errPeaks
+}
+
+// computePeaks reads signed 16bit little endian mono PCM at sampleRate and takes resolution peaks per second
+func computePeaks(r io.Reader, sampleRate, resolution int) (*waveform, error) {
+	samplesPerPeak := sampleRate / resolution
+	if samplesPerPeak < 1 {
+		return nil, fmt.Errorf("resolution %d is higher than sample rate %d", resolution, sampleRate)
+	}
+
+	w := &waveform{Resolution: resolution, Peaks: make([]int, 0)}
+	br := bufio.NewReader(r)
+	sample := make([]byte, 2)
+	peak, count, total := 0, 0, 0
+	for {
+		if _, err := io.ReadFull(br, sample); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		v := int(int16(binary.LittleEndian.Uint16(sample)))
+		if v < 0 {
+			v = -v
+		}
+		if v > peak {
+			peak = v
+		}
+		count++
+		total++
+		if count == samplesPerPeak {
+			w.Peaks = append(w.Peaks, scalePeak(peak))
+			peak, count = 0, 0
+		}
+	}
+	if count > 0 {
+		// the last interval is shorter
+		w.Peaks = append(w.Peaks, scalePeak(peak))
+	}
+	w.Duration = float64(total) / float64(sampleRate)
+	return w, nil
+}
+
+// scalePeak scales an absolute amplitude of 16bit PCM into [0, waveformMaxPeak]
+func scalePeak(peak int) int {
+	return int(math.Round(float64(peak) * waveformMaxPeak / -math.MinInt16))
+}
+
+// hlsWaveformFilePath returns a path of a waveform of a video transcoded with a profile
+func hlsWaveformFilePath(videoID, profileName string) string {
+	return path.Join(hlsProfileDirPath(videoID, profileName), waveformFilename) // static/streams/videoID/profile/waveform.json
+}
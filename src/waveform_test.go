@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestComputePeaks(t *testing.T) {
+	// 2.5 intervals of 4 samples, with a trailing odd byte which is ignored
+	samples := []int16{0, 100, -200, 50, 32767, 0, 0, 0, -32768, 16384}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, samples)
+	buf.WriteByte(0)
+
+	w, err := computePeaks(buf, 8, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{2, 255, 255}
+	if !reflect.DeepEqual(w.Peaks, expected) {
+		t.Errorf("peaks expected %v, got %v", expected, w.Peaks)
+	}
+	if w.Resolution != 2 || w.Duration != 1.25 {
+		t.Errorf("resolution and duration expected 2 and 1.25, got %d and %f", w.Resolution, w.Duration)
+	}
+
+	if _, err := computePeaks(new(bytes.Buffer), 8, 16); err == nil {
+		t.Error("resolution higher than sample rate should return an error")
+	}
+}
+
+func TestGenerateWaveformOf(t *testing.T) {
+	_, cleanup := withTempStaticDir(t)
+	defer cleanup()
+	originalTranscodes := jManager.transcodes
+	defer func() { jManager.transcodes = originalTranscodes }()
+	jManager.transcodes = newWorkerPool(1)
+
+	profile := transcodeProfiles["aac128"]
+	busy := newTranscodeJob("busy", profile, priorityPlay)
+	if err := jManager.transcodes.acquire(context.Background(), busy); err != nil {
+		t.Fatal(err)
+	}
+
+	// requests which have gone leave a single job waiting for the worker
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 2; i++ {
+		if err := jManager.generateWaveformOf(gone, "abc", profile); err != context.Canceled {
+			t.Errorf("canceled request should return %v, got %v", context.Canceled, err)
+		}
+	}
+	queued := func() int {
+		jManager.transcodes.lock.Lock()
+		defer jManager.transcodes.lock.Unlock()
+		return len(jManager.transcodes.queue)
+	}
+	for deadline := time.Now().Add(time.Second); queued() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := queued(); n != 1 {
+		t.Errorf("a single waveform job should wait for the worker, got %d", n)
+	}
+
+	// the job fails without HLS files, and is reported to a request attached to it
+	jManager.transcodes.release()
+	if err := jManager.generateWaveformOf(context.Background(), "abc", profile); err == nil {
+		t.Error("waveform of a missing stream should fail")
+	}
+	jManager.lock.Lock()
+	defer jManager.lock.Unlock()
+	if len(jManager.waveforms) != 0 {
+		t.Errorf("finished waveform jobs should be removed, got %v", jManager.waveforms)
+	}
+}
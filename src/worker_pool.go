@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// jobPriority decides order of transcode jobs waiting for a worker.
+// A job with larger priority is served first.
+type jobPriority int
+
+const (
+	priorityPrefetch jobPriority = iota // background prefetch nobody is listening to yet
+	priorityPlay                        // a user is waiting to play
+)
+
+// workerPool limits the number of jobs which run a certain task concurrently, e.g. download or FFmpeg.
+// Jobs exceeding the limit wait in a queue ordered by priority, and then by arrival.
+type workerPool struct {
+	lock    sync.Mutex
+	limit   int
+	running int
+	queue   []*poolWaiter
+	seq     uint64 // incremented for each arrival to keep FIFO order among the same priority
+}
+
+// poolWaiter is an entry of a queue in workerPool
+type poolWaiter struct {
+	job      *transcodeJob
+	priority jobPriority
+	seq      uint64
+	granted  chan struct{} // closed when a worker is assigned
+}
+
+func newWorkerPool(limit int) *workerPool {
+	return &workerPool{limit: limit}
+}
+
+// acquire blocks until a worker is assigned to job.
+// If ctx is done before that, job is removed from the queue and ctx.Err() is returned.
+// A successful acquire must be followed by release.
+func (p *workerPool) acquire(ctx context.Context, job *transcodeJob) error {
+	p.lock.Lock()
+	if p.running < p.limit && len(p.queue) == 0 {
+		p.running++
+		p.lock.Unlock()
+		return nil
+	}
+	p.seq++
+	waiter := &poolWaiter{job: job, priority: job.getPriority(), seq: p.seq, granted: make(chan struct{})}
+	p.queue = append(p.queue, waiter)
+	p.sortQueue()
+	p.lock.Unlock()
+
+	select {
+	case <-waiter.granted:
+		return nil
+	case <-ctx.Done():
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		for i, w := range p.queue {
+			if w == waiter {
+				p.queue = append(p.queue[:i], p.queue[i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// worker has been assigned just before removal, give it back
+		p.running--
+		p.dispatch()
+		return ctx.Err()
+	}
+}
+
+// release returns a worker to the pool and assigns it to the next waiting job
+func (p *workerPool) release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.running--
+	p.dispatch()
+}
+
+// setLimit changes the maximum number of concurrent workers
+func (p *workerPool) setLimit(limit int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.limit = limit
+	p.dispatch()
+}
+
+// promote raises priority of job in the queue if it is waiting with a lower priority
+func (p *workerPool) promote(job *transcodeJob, priority jobPriority) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, w := range p.queue {
+		if w.job == job && w.priority < priority {
+			w.priority = priority
+			p.sortQueue()
+			return
+		}
+	}
+}
+
+// position returns 1-based position of job in the queue, or 0 if job is not waiting
+func (p *workerPool) position(job *transcodeJob) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, w := range p.queue {
+		if w.job == job {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// dispatch assigns free workers to waiting jobs.
+// p.lock must be held by the caller.
+func (p *workerPool) dispatch() {
+	for p.running < p.limit && len(p.queue) > 0 {
+		w := p.queue[0]
+		p.queue = p.queue[1:]
+		p.running++
+		close(w.granted)
+	}
+}
+
+// sortQueue orders the queue by priority and arrival.
+// p.lock must be held by the caller.
+func (p *workerPool) sortQueue() {
+	sort.SliceStable(p.queue, func(i, j int) bool {
+		if p.queue[i].priority != p.queue[j].priority {
+			return p.queue[i].priority > p.queue[j].priority
+		}
+		return p.queue[i].seq < p.queue[j].seq
+	})
+}
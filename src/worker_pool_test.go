@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolPriority(t *testing.T) {
+	p := newWorkerPool(1)
+	running := newTranscodeJob("running", transcodeProfiles[defaultProfileName], priorityPlay)
+	if err := p.acquire(context.Background(), running); err != nil {
+		t.Fatal(err)
+	}
+
+	// enqueue jobs in order of prefetch1, prefetch2, play
+	prefetch1 := newTranscodeJob("prefetch1", transcodeProfiles[defaultProfileName], priorityPrefetch)
+	prefetch2 := newTranscodeJob("prefetch2", transcodeProfiles[defaultProfileName], priorityPrefetch)
+	play := newTranscodeJob("play", transcodeProfiles[defaultProfileName], priorityPlay)
+	order := make(chan string, 3)
+	for _, j := range []*transcodeJob{prefetch1, prefetch2, play} {
+		go func(j *transcodeJob) {
+			if err := p.acquire(context.Background(), j); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- j.videoID
+			p.release()
+		}(j)
+		waitForQueueing(t, p, j)
+	}
+
+	if pos := p.position(play); pos != 1 {
+		t.Errorf("position of play expected %d, got %d", 1, pos)
+	}
+	if pos := p.position(prefetch2); pos != 3 {
+		t.Errorf("position of prefetch2 expected %d, got %d", 3, pos)
+	}
+
+	// promote prefetch2 so that it precedes play which arrived later
+	p.promote(prefetch2, priorityPlay)
+	if pos := p.position(prefetch2); pos != 1 {
+		t.Errorf("position of promoted prefetch2 expected %d, got %d", 1, pos)
+	}
+
+	p.release()
+	for _, expected := range []string{"prefetch2", "play", "prefetch1"} {
+		select {
+		case id := <-order:
+			if id != expected {
+				t.Errorf("job expected %s, got %s", expected, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("job %s did not get a worker", expected)
+		}
+	}
+}
+
+func TestWorkerPoolCancel(t *testing.T) {
+	p := newWorkerPool(1)
+	if err := p.acquire(context.Background(), newTranscodeJob("running", transcodeProfiles[defaultProfileName], priorityPlay)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := newTranscodeJob("waiting", transcodeProfiles[defaultProfileName], priorityPlay)
+	errc := make(chan error)
+	go func() { errc <- p.acquire(ctx, waiting) }()
+	waitForQueueing(t, p, waiting)
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("acquire expected %v, got %v", context.Canceled, err)
+	}
+	if pos := p.position(waiting); pos != 0 {
+		t.Errorf("canceled job should be removed from queue, got position %d", pos)
+	}
+}
+
+// waitForQueueing blocks until job appears in a queue of p
+func waitForQueueing(t *testing.T, p *workerPool, job *transcodeJob) {
+	deadline := time.Now().Add(time.Second)
+	for p.position(job) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is not queued", job.videoID)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
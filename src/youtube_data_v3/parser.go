@@ -13,6 +13,10 @@ import (
 var (
 	// durationRegex = regexp.MustCompile(`PT(?P<hour>[0-9]+H)?(?P<minute>[0-9]+M)?(?P<second>[0-9]+S)`)
 	durationRegex = regexp.MustCompile(`PT([0-9HMS]+)`)
+	// timestampRegex matches a timestamp in a description such as "1:02:03", "02:03", or "2:03"
+	timestampRegex = regexp.MustCompile(`(?:(\d{1,2}):)?(\d{1,2}):(\d{2})`)
+	// trackNumberRegex matches a track number preceding a chapter title such as "01.", "Track 01"
+	trackNumberRegex = regexp.MustCompile(`^(?i:track)?\s*\d{1,3}\s*[.)]?\s`)
 )
 
 func parseSearchResult(r io.ReadCloser) ([]string, error) {
@@ -43,6 +47,8 @@ func parseVideosDetails(r io.ReadCloser) ([]Video, error) {
 			Snippet struct {
 				PublishedAt string `json:"publishedAt"`
 				Title       string `json:"title"`
+				Channel     string `json:"channelTitle"`
+				Description string `json:"description"`
 				Thumbnails  struct {
 					Default struct {
 						URL    string `json:"url"`
@@ -93,6 +99,7 @@ func parseVideosDetails(r io.ReadCloser) ([]Video, error) {
 		v := Video{
 			ID:          item.ID,
 			Title:       item.Snippet.Title,
+			Channel:     item.Snippet.Channel,
 			Duration:    duration,
 			ViewCount:   viewCount,
 			PublishDate: strings.Split(item.Snippet.PublishedAt, "T")[0],
@@ -123,6 +130,7 @@ func parseVideosDetails(r io.ReadCloser) ([]Video, error) {
 					Height: item.Snippet.Thumbnails.Maxres.Height,
 				},
 			},
+			Chapters: parseChapters(item.Snippet.Description, duration),
 		}
 		videos = append(videos, v)
 	}
@@ -142,3 +150,56 @@ func parseDuration(dur string) time.Duration {
 	duration, _ := time.ParseDuration(strings.ToLower(matched[1])) // ParseDuration only deals lowercase units
 	return duration
 }
+
+// parseChapters extracts chapters from timestamps in a description, following rules of YouTube chapters,
+// i.e. timestamps ascend from 0:00 and there are at least 2 of them. Timestamps out of the order are ignored.
+// A line with a timestamp is regarded as a chapter, and the rest of the line is its title, e.g.
+//   0:00 : Main theme
+//   Track 02 [ 0:02:58 ] - その未来へ (TVsize)
+//   03. Piano: A Beautiful Song 13:13
+// The last chapter ends at duration. nil is returned if the description has no chapter.
+func parseChapters(description string, duration time.Duration) []Chapter {
+	chapters := make([]Chapter, 0)
+	for _, line := range strings.Split(description, "\n") {
+		loc := timestampRegex.FindStringSubmatchIndex(line)
+		if loc == nil {
+			continue
+		}
+		start := parseTimestamp(line, loc)
+		if len(chapters) == 0 && start != 0 {
+			// chapters start from 0:00, this is a timestamp mentioned elsewhere
+			continue
+		}
+		if len(chapters) > 0 && start <= chapters[len(chapters)-1].Start {
+			// a timestamp mentioned after the list of chapters
+			continue
+		}
+
+		// text around the timestamp is a title, which may be decorated with a track number, brackets, and separators
+		before := strings.TrimRight(trackNumberRegex.ReplaceAllString(strings.TrimSpace(line[:loc[0]]), ""), " \t:-|[(")
+		after := strings.TrimLeft(line[loc[1]:], " \t:-|])")
+		title := strings.TrimSpace(strings.TrimSpace(before) + " " + strings.TrimSpace(after))
+		if len(chapters) > 0 {
+			chapters[len(chapters)-1].End = start
+		}
+		chapters = append(chapters, Chapter{Title: title, Start: start, End: duration})
+	}
+	if len(chapters) < 2 {
+		return nil
+	}
+	return chapters
+}
+
+// parseTimestamp converts a timestamp matched at loc in s into time.Duration
+func parseTimestamp(s string, loc []int) time.Duration {
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		if loc[2*i+2] < 0 {
+			// hour is omitted
+			continue
+		}
+		n, _ := strconv.Atoi(s[loc[2*i+2]:loc[2*i+3]])
+		d += time.Duration(n) * unit
+	}
+	return d
+}
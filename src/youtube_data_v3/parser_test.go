@@ -64,3 +64,55 @@ func TestParseVideosDetails(t *testing.T) {
 	}
 
 }
+
+func TestParseChapters(t *testing.T) {
+	cases := []struct {
+		name        string
+		description string
+		expected    []Chapter
+	}{
+		{
+			"title after timestamp",
+			"★ Music : \n\n0:00 : Main theme \n2:17 : A Doll's Beginning\n23:17 :Ink to Paper\n43:21: Each Memory a Message\n1:01:57 : The Ultimate Price\n\n★ Album :http://www.cdjapan.co.jp/product/LACA-9573",
+			[]Chapter{
+				{"Main theme", 0, 2*time.Minute + 17*time.Second},
+				{"A Doll's Beginning", 2*time.Minute + 17*time.Second, 23*time.Minute + 17*time.Second},
+				{"Ink to Paper", 23*time.Minute + 17*time.Second, 43*time.Minute + 21*time.Second},
+				{"Each Memory a Message", 43*time.Minute + 21*time.Second, time.Hour + time.Minute + 57*time.Second},
+				{"The Ultimate Price", time.Hour + time.Minute + 57*time.Second, 2 * time.Hour},
+			},
+		},
+		{
+			"track number and brackets",
+			"TRACKLIST:\n\nDISC 1\n\nTrack 01 [ 0:00:00 ] - 心の唄 -PV ver-\nTrack 02 [ 0:02:58 ] - その未来へ (TVsize)\n",
+			[]Chapter{
+				{"心の唄 -PV ver-", 0, 2*time.Minute + 58*time.Second},
+				{"その未来へ (TVsize)", 2*time.Minute + 58*time.Second, 2 * time.Hour},
+			},
+		},
+		{
+			"title before timestamp",
+			"Tracklist:\n\n01. Piano: Weight of the World 00:00\n02. Piano: Amusement Park 06:19\n",
+			[]Chapter{
+				{"Piano: Weight of the World", 0, 6*time.Minute + 19*time.Second},
+				{"Piano: Amusement Park", 6*time.Minute + 19*time.Second, 2 * time.Hour},
+			},
+		},
+		{
+			"timestamps out of the list are ignored",
+			"Live at 20:30\n0:00 Intro\n3:10 Outro\nThanks for 1:00 of your time",
+			[]Chapter{
+				{"Intro", 0, 3*time.Minute + 10*time.Second},
+				{"Outro", 3*time.Minute + 10*time.Second, 2 * time.Hour},
+			},
+		},
+		{"a single timestamp", "0:00 Intro\nno more", nil},
+		{"no timestamp", "Copyright disclaimer: We do not own ANY rights", nil},
+	}
+	for _, c := range cases {
+		chapters := parseChapters(c.description, 2*time.Hour)
+		if !reflect.DeepEqual(chapters, c.expected) {
+			t.Errorf("%s: chapters expected %v, got %v", c.name, c.expected, chapters)
+		}
+	}
+}
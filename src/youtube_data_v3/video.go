@@ -8,10 +8,19 @@ import (
 type Video struct {
 	ID          string        `json:"id"`
 	Title       string        `json:"title"`
+	Channel     string        `json:"channel"`
 	Duration    time.Duration `json:"duration"`
 	ViewCount   int           `json:"view_count"`
 	PublishDate string        `json:"publish_date"`
 	Thumbnails  Thumbnails    `json:"thumbnail"`
+	Chapters    []Chapter     `json:"chapters,omitempty"`
+}
+
+// Chapter is a section of a video designated by a timestamp in its description, e.g. a track of an album
+type Chapter struct {
+	Title string        `json:"title"`
+	Start time.Duration `json:"start"`
+	End   time.Duration `json:"end"`
 }
 
 // Thumbnails holds info of several thumbnail images with different sizes
@@ -23,6 +32,17 @@ type Thumbnails struct {
 	Maxres   ThumbnailDetail `json:"maxres"`
 }
 
+// Largest returns the largest thumbnail image available, since some sizes are missing for some videos.
+// An empty ThumbnailDetail is returned if there is no thumbnail.
+func (t Thumbnails) Largest() ThumbnailDetail {
+	for _, d := range []ThumbnailDetail{t.Maxres, t.Standard, t.High, t.Medium, t.Default} {
+		if d.URL != "" {
+			return d
+		}
+	}
+	return ThumbnailDetail{}
+}
+
 // ThumbnailDetail holds url and size of a thumbnail image
 type ThumbnailDetail struct {
 	URL    string `json:"url"`
@@ -118,6 +118,9 @@ func TestRelated(t *testing.T) {
 				if v.ViewCount != 9195 {
 					t.Errorf("id=%s: view count expected %d, got %d ", v.ID, 9195, v.ViewCount)
 				}
+				if v.Channel != "Maelka" {
+					t.Errorf("id=%s: channel expected %s, got %s ", v.ID, "Maelka", v.Channel)
+				}
 				if v.PublishDate != "2018-03-28" {
 					t.Errorf("id=%s: publish date expected %s, got %s ", v.ID, "2018-03-28", v.PublishDate)
 				}
@@ -131,6 +134,9 @@ func TestRelated(t *testing.T) {
 				if !reflect.DeepEqual(v.Thumbnails, expectedThumbnails) {
 					t.Errorf("id=%s: thumbnails expected %v, got %v ", v.ID, expectedThumbnails, v.Thumbnails)
 				}
+				if largest := v.Thumbnails.Largest(); largest != expectedThumbnails.Standard {
+					t.Errorf("id=%s: largest thumbnail without maxres expected %v, got %v ", v.ID, expectedThumbnails.Standard, largest)
+				}
 			}
 		}
 	}
@@ -169,6 +175,11 @@ func TestGet(t *testing.T) {
 		if v.ViewCount != 9244 {
 			t.Errorf("id=%s: view count expected %d, got %d ", "lhu8HWc9TlA", 9244, v.ViewCount)
 		}
+		if len(v.Chapters) != 47 {
+			t.Errorf("id=%s: number of chapters expected %d, got %d ", "lhu8HWc9TlA", 47, len(v.Chapters))
+		} else if last := v.Chapters[46]; last.Title != "Letter (Short Size)" || last.Start != time.Hour*1+time.Minute*45+time.Second*13 || last.End != v.Duration {
+			t.Errorf("id=%s: last chapter expected %s from %s to %s, got %v ", "lhu8HWc9TlA", "Letter (Short Size)", time.Hour*1+time.Minute*45+time.Second*13, v.Duration, last)
+		}
 		if v.PublishDate != "2018-03-28" {
 			t.Errorf("id=%s: publish date expected %s, got %s ", "lhu8HWc9TlA", "2018-03-28", v.PublishDate)
 		}